@@ -0,0 +1,430 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rdbell/go-nostr"
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// adminRoutes sets up the operators' admin routes
+func adminRoutes(e *echo.Echo) {
+	e.GET("/admin", isLoggedIn(isOperatorUser(adminHandler)))
+	e.POST("/admin/jobs/:job", isLoggedIn(isOperatorUser(adminJobHandler)))
+}
+
+const (
+	// recentErrorsLimit is how many recent errors are kept for the admin dashboard
+	recentErrorsLimit = 50
+	// ingestRateMinutes is how many minutes of ingest counts are kept for the admin dashboard
+	ingestRateMinutes = 60
+	// adminActionsLimit caps the number of recent moderation actions on the admin dashboard
+	adminActionsLimit = 20
+)
+
+// recentError defines an error recorded for the admin dashboard
+type recentError struct {
+	Time    uint32 // when the error happened
+	Source  string // request path, relay or job that caused the error
+	Message string
+}
+
+// relayStatus defines a configured relay's state
+type relayStatus struct {
+	URL          string
+	Connected    bool   // whether the relay was reachable when the gateway started
+	Notices      int    // number of notices the relay has sent
+	LastNotice   string // latest notice's message
+	LastNoticeAt uint32 // latest notice's timestamp
+}
+
+// ingestRate defines the number of events received over a recent period
+type ingestRate struct {
+	Minutes int
+	Events  int
+}
+
+// ingestKindCount defines the number of events of one kind received since the gateway started
+type ingestKindCount struct {
+	Kind  int
+	Count int
+}
+
+// tableSize defines the number of rows in a SQLite table
+type tableSize struct {
+	Name string
+	Rows int
+}
+
+// adminJob defines a maintenance job that operators can trigger from the dashboard
+type adminJob struct {
+	Name        string       // job name used in the URL
+	Description string       // what the job does
+	run         func() error // the job itself
+	Running     bool         // whether the job is running now
+	LastRun     uint32       // when the job last finished
+	LastTook    uint32       // how many seconds the last run took
+	LastError   string       // the last run's error, if any
+}
+
+// adminState holds the statistics shown on the admin dashboard
+var adminState = struct {
+	sync.Mutex
+	errors       []*recentError
+	relays       map[string]*relayStatus
+	minutes      [ingestRateMinutes]int    // events received in each recent minute, indexed by unix minute
+	minuteStamps [ingestRateMinutes]uint32 // unix minute each count belongs to
+	kinds        map[int]int               // events received by kind
+	dropped      map[string]int            // events dropped by reason
+	startedAt    uint32
+}{
+	relays:    make(map[string]*relayStatus),
+	kinds:     make(map[int]int),
+	dropped:   make(map[string]int),
+	startedAt: uint32(time.Now().Unix()),
+}
+
+// adminJobs lists the maintenance jobs, in the order they're shown on the dashboard
+var adminJobs = []*adminJob{
+	{Name: "rankings", Description: "recompute every post's ranking from its score, age and proof-of-work", run: recomputeRankings},
+	{Name: "weights", Description: "recompute every vote's weight from its voter's current standing, then the affected posts' scores and rankings", run: recomputeVoteWeights},
+	{Name: "search", Description: "rebuild the SQLite indexes used by search and listings, and refresh the query planner's statistics", run: reindexSearch},
+	{Name: "insights", Description: "re-run the vote manipulation analysis now", run: refreshInsights},
+	{Name: "trust", Description: "queue a rebuild of every web of trust in use", run: rebuildTrustGraphs},
+}
+
+// adminHandler serves the operators' admin dashboard
+func adminHandler(c echo.Context) error {
+	var page struct {
+		Relays      []*relayStatus
+		Rates       []*ingestRate
+		Kinds       []*ingestKindCount
+		Dropped     map[string]int
+		StartedAt   uint32
+		Tables      []*tableSize
+		Errors      []*recentError
+		ReviewQueue int
+		Hidden      int
+		Blocklist   int
+		Removed     int
+		Locked      int
+		Pinned      int
+		Announced   int
+		Actions     []*schemas.ModerationAction
+		Jobs        []*adminJob
+	}
+
+	page.Relays = relayStatuses()
+	page.Rates, page.Kinds, page.Dropped, page.StartedAt = ingestStats()
+	page.Errors = recentErrors()
+	page.Jobs = adminJobStatuses()
+
+	var err error
+	page.Tables, err = tableSizes()
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	// Queue sizes
+	items, err := reviewQueue()
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+	page.ReviewQueue = len(items)
+	db.QueryRow(`SELECT (SELECT COUNT(*) FROM gateway_hidden_posts) + (SELECT COUNT(*) FROM gateway_hidden_users)`).Scan(&page.Hidden)
+	db.QueryRow(`SELECT COUNT(*) FROM blocklist`).Scan(&page.Blocklist)
+	db.QueryRow(`SELECT COUNT(*) FROM removed_posts`).Scan(&page.Removed)
+	db.QueryRow(`SELECT COUNT(DISTINCT target) FROM closed_threads`).Scan(&page.Locked)
+	db.QueryRow(`SELECT COUNT(*) FROM pinned_posts`).Scan(&page.Pinned)
+	db.QueryRow(`SELECT COUNT(*) FROM announced_posts`).Scan(&page.Announced)
+
+	page.Actions, err = recentModerationActions(adminActionsLimit)
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	pd := new(pageData).Init(c)
+	pd.Title = "Admin"
+	pd.Page = page
+	return c.Render(http.StatusOK, "base:admin", pd)
+}
+
+// adminJobHandler starts a maintenance job in the background
+func adminJobHandler(c echo.Context) error {
+	var job *adminJob
+	for _, j := range adminJobs {
+		if j.Name == c.Param("job") {
+			job = j
+		}
+	}
+	if job == nil {
+		return serveError(c, http.StatusNotFound, errors.New("no such job"))
+	}
+
+	adminState.Lock()
+	running := job.Running
+	job.Running = true
+	adminState.Unlock()
+	if running {
+		return serveError(c, http.StatusConflict, errors.New("job is already running"))
+	}
+
+	go func() {
+		start := time.Now()
+		log.Printf("admin job %s started\n", job.Name)
+		err := job.run()
+
+		adminState.Lock()
+		job.Running = false
+		job.LastRun = uint32(time.Now().Unix())
+		job.LastTook = uint32(time.Since(start).Seconds())
+		job.LastError = ""
+		if err != nil {
+			job.LastError = err.Error()
+		}
+		adminState.Unlock()
+
+		if err != nil {
+			recordError("job "+job.Name, err)
+		}
+		log.Printf("admin job %s finished in %s\n", job.Name, time.Since(start))
+	}()
+
+	return c.Redirect(http.StatusFound, "/admin")
+}
+
+// adminJobStatuses returns a copy of each maintenance job's status, so the page can render while jobs run
+func adminJobStatuses() []*adminJob {
+	adminState.Lock()
+	defer adminState.Unlock()
+
+	var jobs []*adminJob
+	for _, job := range adminJobs {
+		status := *job
+		jobs = append(jobs, &status)
+	}
+	return jobs
+}
+
+// recordError keeps an error for the admin dashboard, dropping the oldest once the limit is reached
+func recordError(source string, err error) {
+	adminState.Lock()
+	defer adminState.Unlock()
+
+	adminState.errors = append(adminState.errors, &recentError{Time: uint32(time.Now().Unix()), Source: source, Message: err.Error()})
+	if len(adminState.errors) > recentErrorsLimit {
+		adminState.errors = adminState.errors[len(adminState.errors)-recentErrorsLimit:]
+	}
+}
+
+// recentErrors returns the recorded errors, newest first
+func recentErrors() []*recentError {
+	adminState.Lock()
+	defer adminState.Unlock()
+
+	errs := make([]*recentError, len(adminState.errors))
+	for i, err := range adminState.errors {
+		errs[len(errs)-1-i] = err
+	}
+	return errs
+}
+
+// recordNotice counts a notice from a relay and keeps it as a recent error
+func recordNotice(notice *nostr.NoticeMessage) {
+	adminState.Lock()
+	status, ok := adminState.relays[notice.Relay]
+	if !ok {
+		status = &relayStatus{URL: notice.Relay}
+		adminState.relays[notice.Relay] = status
+	}
+	status.Notices++
+	status.LastNotice = notice.Message
+	status.LastNoticeAt = uint32(time.Now().Unix())
+	adminState.Unlock()
+
+	recordError(notice.Relay, errors.New(notice.Message))
+}
+
+// recordIngest counts an event received from the relays
+func recordIngest(kind int) {
+	adminState.Lock()
+	defer adminState.Unlock()
+
+	minute := uint32(time.Now().Unix() / 60)
+	i := minute % ingestRateMinutes
+	if adminState.minuteStamps[i] != minute {
+		adminState.minuteStamps[i] = minute
+		adminState.minutes[i] = 0
+	}
+	adminState.minutes[i]++
+	adminState.kinds[kind]++
+}
+
+// recordDrop counts an event dropped at ingest
+func recordDrop(reason string) {
+	adminState.Lock()
+	defer adminState.Unlock()
+
+	adminState.dropped[reason]++
+}
+
+// ingestStats returns event counts over the last 1, 5 and 60 minutes, by kind, and by drop reason, along with when the gateway started
+func ingestStats() ([]*ingestRate, []*ingestKindCount, map[string]int, uint32) {
+	adminState.Lock()
+	defer adminState.Unlock()
+
+	now := uint32(time.Now().Unix() / 60)
+	var rates []*ingestRate
+	for _, minutes := range []int{1, 5, ingestRateMinutes} {
+		rate := &ingestRate{Minutes: minutes}
+		for i := range adminState.minutes {
+			if stamp := adminState.minuteStamps[i]; stamp != 0 && now-stamp < uint32(minutes) {
+				rate.Events += adminState.minutes[i]
+			}
+		}
+		rates = append(rates, rate)
+	}
+
+	var kinds []*ingestKindCount
+	for kind, count := range adminState.kinds {
+		kinds = append(kinds, &ingestKindCount{Kind: kind, Count: count})
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Count > kinds[j].Count })
+
+	dropped := make(map[string]int)
+	for reason, count := range adminState.dropped {
+		dropped[reason] = count
+	}
+
+	return rates, kinds, dropped, adminState.startedAt
+}
+
+// relayStatuses returns the state of every configured relay
+func relayStatuses() []*relayStatus {
+	adminState.Lock()
+	defer adminState.Unlock()
+
+	var statuses []*relayStatus
+	for _, relay := range appConfig.Relays {
+		url := nostr.NormalizeURL(relay)
+		status := &relayStatus{URL: url}
+		if recorded, ok := adminState.relays[url]; ok {
+			*status = *recorded
+		}
+		if pool != nil {
+			_, status.Connected = pool.Relays[url]
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// tableSizes queries the DB and returns the number of rows in each table
+func tableSizes() ([]*tableSize, error) {
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []*tableSize
+	for rows.Next() {
+		table := &tableSize{}
+		if rows.Scan(&table.Name) == nil {
+			tables = append(tables, table)
+		}
+	}
+	rows.Close()
+
+	// Table names come from sqlite_master, not user input
+	for _, table := range tables {
+		db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, table.Name)).Scan(&table.Rows)
+	}
+
+	return tables, rows.Err()
+}
+
+// recomputeRankings recomputes every post's ranking, e.g. after changing the vote weighting or proof-of-work settings
+func recomputeRankings() error {
+	type ranking struct {
+		id      string
+		ranking float64
+	}
+
+	rows, err := db.Query(`SELECT id, score, weighted_score, created_at, pow, parent FROM posts`)
+	if err != nil {
+		return err
+	}
+
+	var rankings []*ranking
+	for rows.Next() {
+		var id, parent string
+		var score int
+		var weightedScore float64
+		var createdAt uint32
+		var pow int
+		if err = rows.Scan(&id, &score, &weightedScore, &createdAt, &pow, &parent); err != nil {
+			rows.Close()
+			return err
+		}
+
+		rankings = append(rankings, &ranking{id: id, ranking: postRanking(weightedScore, createdAt, pow, parent)})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range rankings {
+		if _, err = tx.Exec(`UPDATE posts SET ranking = ? WHERE id = ?`, r.ranking, r.id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// reindexSearch rebuilds the DB's indexes and refreshes the statistics the query planner uses for search and listings
+func reindexSearch() error {
+	_, err := db.Exec(`REINDEX; ANALYZE;`)
+	return err
+}
+
+// refreshInsights re-runs the vote manipulation analysis
+func refreshInsights() error {
+	report, err := buildInsightsReport()
+	if err != nil {
+		return err
+	}
+
+	insightsCache.Lock()
+	insightsCache.report = report
+	insightsCache.Unlock()
+	return nil
+}
+
+// rebuildTrustGraphs queues a rebuild of every web of trust that's in use
+func rebuildTrustGraphs() error {
+	trustGraphs.Lock()
+	var viewers []string
+	for viewer := range trustGraphs.lastUsed {
+		viewers = append(viewers, viewer)
+	}
+	trustGraphs.Unlock()
+
+	for _, viewer := range viewers {
+		queueTrustRebuild(viewer)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rdbell/nvote/schemas"
+)
+
+// archivedAt returns when a thread created at a timestamp is archived, or 0 if archiving is disabled
+func archivedAt(createdAt uint32) uint32 {
+	if appConfig.ArchiveAfterDays <= 0 {
+		return 0
+	}
+	return createdAt + uint32(appConfig.ArchiveAfterDays)*24*60*60
+}
+
+// isArchived returns true if a thread created at a timestamp is archived
+func isArchived(createdAt uint32) bool {
+	archived := archivedAt(createdAt)
+	return archived != 0 && uint32(time.Now().Unix()) > archived
+}
+
+// threadStatus returns whether the thread a post belongs to is locked or archived, or an empty string if it's open
+func threadStatus(id string) string {
+	var root string
+	var createdAt uint32
+	err := db.QueryRow(`SELECT roots.id, roots.created_at FROM posts JOIN posts AS roots ON roots.id = posts.root WHERE posts.id = ?`, id).Scan(&root, &createdAt)
+	if err != nil {
+		return ""
+	}
+
+	if isLocked(root) {
+		return schemas.ThreadLocked
+	}
+	if isArchived(createdAt) {
+		return schemas.ThreadArchived
+	}
+	return ""
+}
+
+// replyAccepted returns false if an incoming reply was posted after its thread was archived or locked by its author
+// moderator locks are only applied at query time by lockedStmt, so viewers who ignore channel moderation still see the replies.
+// author locks that arrive after the reply are applied there too
+func replyAccepted(post *schemas.Post) bool {
+	if !post.IsValidComment() {
+		return true
+	}
+
+	op, err := getOP(post.Parent)
+	if err != nil || op == nil {
+		return true
+	}
+
+	posted := post.PostedAt
+	if posted < post.CreatedAt {
+		posted = post.CreatedAt
+	}
+
+	if archived := archivedAt(op.CreatedAt); archived != 0 && posted > archived {
+		return false
+	}
+
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM author_locked_threads WHERE target = ? AND created_at < ?`, op.ID, posted).Scan(&count)
+	return count == 0
+}
+
+// postedAt returns when an incoming post counts as posted for thread locks and archiving
+// that's normally its own timestamp, which the sender chooses. once the gateway has caught up with the relays, posts arrive
+// moments after they're created, so one arriving long after its timestamp was backdated, and counts from when it arrived instead.
+// arrival times are kept in the first seen file alongside pubkeys', so backdated replies stay locked out after a restart
+func postedAt(post *schemas.Post) uint32 {
+	gatewaySeen.Lock()
+	defer gatewaySeen.Unlock()
+
+	if at, ok := gatewaySeen.at[post.ID]; ok && at > post.CreatedAt {
+		return at
+	}
+
+	now := uint32(time.Now().Unix())
+	if !caughtUp() || now <= post.CreatedAt+maxClockSkew {
+		return post.CreatedAt
+	}
+
+	gatewaySeen.at[post.ID] = now
+	if gatewaySeen.file != nil {
+		fmt.Fprintf(gatewaySeen.file, "%s %d\n", post.ID, now)
+	}
+
+	return now
+}
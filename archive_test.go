@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rdbell/nvote/schemas"
+)
+
+// testReply returns a reply to a post for the thread tests
+func testReply(n int, parent *schemas.Post, createdAt uint32) *schemas.Post {
+	reply := testPost(n, strings.Repeat("4", 64), createdAt, "", "a reply")
+	reply.Parent = parent.ID
+	return reply
+}
+
+// withCaughtUp runs a function as if the gateway had or hadn't caught up with the relays yet
+func withCaughtUp(caught bool, f func()) {
+	saved := adminState.startedAt
+	defer func() { adminState.startedAt = saved }()
+
+	adminState.startedAt = uint32(time.Now().Unix())
+	if caught {
+		adminState.startedAt = uint32(time.Now().Add(-relayCatchUpDelay).Unix())
+	}
+	f()
+}
+
+func TestReplyAccepted(t *testing.T) {
+	author := strings.Repeat("3", 64)
+	now := uint32(time.Now().Unix())
+	defer db.Exec(`DELETE FROM posts WHERE channel = 'threadtest'`)
+	defer db.Exec(`DELETE FROM moderation_actions WHERE pubkey = ?`, author)
+
+	savedArchive := appConfig.ArchiveAfterDays
+	appConfig.ArchiveAfterDays = 1
+	defer func() { appConfig.ArchiveAfterDays = savedArchive }()
+
+	accepted := func(reply *schemas.Post) bool {
+		reply.PostedAt = postedAt(reply)
+		return replyAccepted(reply)
+	}
+
+	// Thread locked by its author an hour ago
+	locked := testPost(201, author, now-7200, "locked thread", "body")
+	locked.Channel = "threadtest"
+	if err := insertPost(locked); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec(`INSERT INTO moderation_actions(id, pubkey, target, action, reason, expires, front_page, created_at) VALUES(?,?,?,?,?,?,?,?)`,
+		strings.Repeat("9", 64), author, locked.ID, "lock", "", 0, false, now-3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withCaughtUp(true, func() {
+		if accepted(testReply(202, locked, now)) {
+			t.Error("reply after the lock accepted")
+		}
+		if accepted(testReply(203, locked, now-5400)) {
+			t.Error("reply backdated to before the lock accepted after catching up")
+		}
+	})
+	withCaughtUp(false, func() {
+		if !accepted(testReply(205, locked, now-5400)) {
+			t.Error("reply from before the lock rejected while catching up")
+		}
+	})
+
+	// Thread archived two days ago
+	archived := testPost(206, author, now-3*86400, "archived thread", "body")
+	archived.Channel = "threadtest"
+	if err := insertPost(archived); err != nil {
+		t.Fatal(err)
+	}
+	withCaughtUp(true, func() {
+		if accepted(testReply(207, archived, now)) {
+			t.Error("reply after archiving accepted")
+		}
+		if accepted(testReply(208, archived, now-3*86400+3600)) {
+			t.Error("reply backdated to before archiving accepted after catching up")
+		}
+	})
+	withCaughtUp(false, func() {
+		if !accepted(testReply(209, archived, now-3*86400+3600)) {
+			t.Error("reply from before archiving rejected while catching up")
+		}
+	})
+}
+
+func TestLockedStmt(t *testing.T) {
+	author := strings.Repeat("5", 64)
+	now := uint32(time.Now().Unix())
+	defer db.Exec(`DELETE FROM posts WHERE channel = 'locktest'`)
+	defer db.Exec(`DELETE FROM moderation_actions WHERE pubkey = ?`, author)
+
+	thread := testPost(301, author, now-7200, "thread", "body")
+	thread.Channel = "locktest"
+	if err := insertPost(thread); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replies stored before the lock arrived
+	before := testReply(302, thread, now-5400)
+	backdated := testReply(303, thread, now-5400)
+	backdated.PostedAt = now - 60
+	for _, reply := range []*schemas.Post{before, backdated} {
+		if err := insertPost(reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := db.Exec(`INSERT INTO moderation_actions(id, pubkey, target, action, reason, expires, front_page, created_at) VALUES(?,?,?,?,?,?,?,?)`,
+		strings.Repeat("8", 64), author, thread.ID, "lock", "", 0, false, now-3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	visible := make(map[string]bool)
+	rows, err := db.Query(`SELECT id FROM posts WHERE root = ?`+lockedStmt, thread.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		visible[id] = true
+	}
+
+	if !visible[before.ID] {
+		t.Error("reply posted before the lock hidden")
+	}
+	if visible[backdated.ID] {
+		t.Error("backdated reply that arrived after the lock shown")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rdbell/go-nostr"
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// blocklistRoutes sets up the operators' blocklist routes
+func blocklistRoutes(e *echo.Echo) {
+	e.GET("/admin/blocklist", isLoggedIn(isOperatorUser(blocklistHandler)))
+	e.POST("/admin/blocklist", isLoggedIn(isOperatorUser(blocklistSubmitHandler)))
+}
+
+const (
+	// blockTypeEvent blocks a single post or comment by its event ID
+	blockTypeEvent = "event"
+	// blockTypePubkey blocks every event from a pubkey
+	blockTypePubkey = "pubkey"
+	// blockTypeChannel blocks every post in a channel
+	blockTypeChannel = "channel"
+	// blockTypeDomain blocks posts linking to a domain or its subdomains
+	blockTypeDomain = "domain"
+)
+
+// blockTypes lists the blocklist entry types, in the order they're shown to operators
+var blockTypes = []string{blockTypeEvent, blockTypePubkey, blockTypeChannel, blockTypeDomain}
+
+// blockedStmt is a SQL condition excluding posts blocked by the gateway's operators
+const blockedStmt = " AND posts.id NOT IN (SELECT value FROM blocklist WHERE type = 'event')" +
+	" AND posts.pubkey NOT IN (SELECT value FROM blocklist WHERE type = 'pubkey')" +
+	" AND posts.channel NOT IN (SELECT value FROM blocklist WHERE type = 'channel')" +
+	" AND posts.id NOT IN (SELECT post_id FROM blocked_links)"
+
+// blocklistFileMutex serializes rewrites of the blocklist file
+var blocklistFileMutex sync.Mutex
+
+// blockEntry defines one entry on the operators' blocklist
+type blockEntry struct {
+	Type      string `form:"type"`   // event, pubkey, channel or domain
+	Value     string `form:"value"`  // event ID, pubkey, channel name or domain
+	Reason    string `form:"reason"` // reason shown in the "removed by this gateway" notice
+	Remove    bool   `form:"remove"` // remove the entry instead of adding it
+	CreatedAt uint32 `form:"-"`      // when the entry was added
+}
+
+// normalize cleans up an entry's value for its type, and returns an error if the value isn't valid
+func (entry *blockEntry) normalize() error {
+	entry.Value = strings.TrimSpace(entry.Value)
+	entry.Reason = strings.TrimSpace(entry.Reason)
+
+	switch entry.Type {
+	case blockTypeEvent, blockTypePubkey:
+		entry.Value = strings.ToLower(entry.Value)
+		if !schemas.IsValidFollow(entry.Value) {
+			return errors.New("invalid " + entry.Type)
+		}
+	case blockTypeChannel:
+		entry.Value = schemas.SanitizeChannel(entry.Value)
+		if entry.Value == "" {
+			return errors.New("invalid channel")
+		}
+	case blockTypeDomain:
+		if u, err := url.Parse(entry.Value); err == nil && u.Host != "" {
+			entry.Value = u.Hostname()
+		}
+		entry.Value = sanitizeDomain(entry.Value)
+		if entry.Value == "" {
+			return errors.New("invalid domain")
+		}
+	default:
+		return errors.New("invalid blocklist type")
+	}
+
+	return nil
+}
+
+// blocklistHandler serves the operators' blocklist
+func blocklistHandler(c echo.Context) error {
+	var page struct {
+		Entries []*blockEntry
+		Types   []string
+		File    string
+	}
+	page.Types = blockTypes
+	page.File = appConfig.BlocklistFile
+
+	var err error
+	page.Entries, err = blocklistEntries()
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	pd := new(pageData).Init(c)
+	pd.Title = "Blocklist"
+	pd.Page = page
+	return c.Render(http.StatusOK, "base:blocklist", pd)
+}
+
+// blocklistSubmitHandler adds or removes a blocklist entry and saves the blocklist file
+func blocklistSubmitHandler(c echo.Context) error {
+	entry := &blockEntry{}
+	if err := c.Bind(entry); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+	if err := entry.normalize(); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	var err error
+	if entry.Remove {
+		err = removeBlockEntry(entry)
+	} else {
+		entry.CreatedAt = uint32(time.Now().Unix())
+		err = addBlockEntry(entry)
+	}
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	if err = saveBlocklist(); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	return c.Redirect(http.StatusFound, "/admin/blocklist")
+}
+
+// loadBlocklist reads the blocklist file into the DB
+// each line holds an entry type, a value and an optional reason, separated by whitespace. lines starting with # are ignored
+func loadBlocklist() {
+	if appConfig.BlocklistFile == "" {
+		return
+	}
+
+	file, err := os.Open(appConfig.BlocklistFile)
+	if os.IsNotExist(err) {
+		log.Printf("blocklist file %s doesn't exist yet\n", appConfig.BlocklistFile)
+		return
+	}
+	if err != nil {
+		panic("unable to open blocklist: " + err.Error())
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			log.Printf("skipping blocklist line %q\n", line)
+			continue
+		}
+		entry := &blockEntry{Type: strings.ToLower(fields[0]), Value: fields[1], Reason: strings.Join(fields[2:], " ")}
+		if err := entry.normalize(); err != nil {
+			log.Printf("skipping blocklist line %q: %s\n", line, err)
+			continue
+		}
+		if addBlockEntry(entry) == nil {
+			count++
+		}
+	}
+
+	log.Printf("loaded %d blocklist entries\n", count)
+}
+
+// saveBlocklist writes the blocklist from the DB back to the blocklist file
+// the file is written to a temporary path first, so a failed write doesn't lose the existing blocklist
+func saveBlocklist() error {
+	if appConfig.BlocklistFile == "" {
+		return nil
+	}
+
+	blocklistFileMutex.Lock()
+	defer blocklistFileMutex.Unlock()
+
+	entries, err := blocklistEntries()
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString("# nvote blocklist: <event|pubkey|channel|domain> <value> [reason]\n")
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s %s %s", entry.Type, entry.Value, strings.ReplaceAll(entry.Reason, "\n", " "))
+		b.WriteString(strings.TrimSpace(line) + "\n")
+	}
+
+	tmp := appConfig.BlocklistFile + ".tmp"
+	if err = os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, appConfig.BlocklistFile)
+}
+
+// blocklistEntries queries the DB and returns every blocklist entry
+func blocklistEntries() ([]*blockEntry, error) {
+	rows, err := db.Query(`SELECT type, value, reason, created_at FROM blocklist ORDER BY type, value`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*blockEntry
+	for rows.Next() {
+		entry := &blockEntry{}
+		err = rows.Scan(&entry.Type, &entry.Value, &entry.Reason, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// addBlockEntry stores a blocklist entry in the DB, updating the reason of an existing entry
+// posts already in the DB that link to a newly blocked domain are recorded in blocked_links
+func addBlockEntry(entry *blockEntry) error {
+	_, err := db.Exec(`INSERT INTO blocklist(type, value, reason, created_at) VALUES(?,?,?,?)
+		ON CONFLICT (type, value) DO UPDATE SET reason=excluded.reason`, entry.Type, entry.Value, entry.Reason, entry.CreatedAt)
+	if err != nil || entry.Type != blockTypeDomain {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT id, title, body FROM posts WHERE title LIKE $1 OR body LIKE $1`, "%"+entry.Value+"%")
+	if err != nil {
+		return err
+	}
+
+	filter := newDomainFilter([]string{entry.Value})
+	var ids []string
+	for rows.Next() {
+		post := &schemas.Post{}
+		if rows.Scan(&post.ID, &post.Title, &post.Body) == nil && filter.Match(post) {
+			ids = append(ids, post.ID)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		db.Exec(`INSERT INTO blocked_links(post_id, domain) VALUES(?,?)`, id, entry.Value)
+	}
+
+	return rows.Err()
+}
+
+// removeBlockEntry deletes a blocklist entry from the DB
+func removeBlockEntry(entry *blockEntry) error {
+	_, err := db.Exec(`DELETE FROM blocklist WHERE type = ? AND value = ?`, entry.Type, entry.Value)
+	if err != nil || entry.Type != blockTypeDomain {
+		return err
+	}
+
+	_, err = db.Exec(`DELETE FROM blocked_links WHERE domain = ?`, entry.Value)
+	return err
+}
+
+// blockReason queries the DB and returns the reason for a blocklist entry, and whether the entry exists
+func blockReason(entryType string, value string) (string, bool) {
+	var reason string
+	err := db.QueryRow(`SELECT reason FROM blocklist WHERE type = ? AND value = ?`, entryType, value).Scan(&reason)
+	return reason, err == nil
+}
+
+// isBlockedEvent returns true if an incoming event or its author is on the blocklist
+func isBlockedEvent(event *nostr.Event) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM blocklist WHERE (type = 'event' AND value = ?) OR (type = 'pubkey' AND value = ?)`, event.ID, event.PubKey).Scan(&count)
+	return count > 0
+}
+
+// blockedDomain returns the first blocked domain a post links to, or an empty string
+func blockedDomain(post *schemas.Post) string {
+	rows, err := db.Query(`SELECT value FROM blocklist WHERE type = 'domain'`)
+	if err != nil {
+		return ""
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var domain string
+		if rows.Scan(&domain) == nil && newDomainFilter([]string{domain}).Match(post) {
+			return domain
+		}
+	}
+	return ""
+}
+
+// isBlockedPost returns true if an incoming post is in a blocked channel or links to a blocked domain
+// comments inherit their thread's channel on insert, so they're caught by blockedStmt at query time instead
+func isBlockedPost(post *schemas.Post) bool {
+	if _, blocked := blockReason(blockTypeChannel, post.Channel); blocked && post.Channel != "" {
+		return true
+	}
+	return blockedDomain(post) != ""
+}
+
+// blockedPostReason returns why a post is blocked, and whether it is
+// posts dropped at ingest aren't in the DB, so only their event ID can be checked
+func blockedPostReason(id string) (string, bool) {
+	if reason, blocked := blockReason(blockTypeEvent, id); blocked {
+		return reason, true
+	}
+
+	post, err := getPost(id)
+	if err != nil {
+		return "", false
+	}
+	if reason, blocked := blockReason(blockTypePubkey, post.PubKey); blocked {
+		return reason, true
+	}
+	if reason, blocked := blockReason(blockTypeChannel, post.Channel); blocked {
+		return reason, true
+	}
+	if domain := blockedDomain(post); domain != "" {
+		return blockReason(blockTypeDomain, domain)
+	}
+
+	return "", false
+}
+
+// removedByGateway serves the "removed by this gateway" notice for blocked content
+func removedByGateway(c echo.Context, reason string) error {
+	message := "removed by this gateway"
+	if reason != "" {
+		message += ": " + reason
+	}
+	return serveError(c, http.StatusUnavailableForLegalReasons, errors.New(message))
+}
@@ -1,10 +1,330 @@
 package main
 
-import "github.com/labstack/echo/v4"
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	checkErr "github.com/rdbell/nvote/check"
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
 
 // channelRoutes sets up channel-related routes
 func channelRoutes(e *echo.Echo) {
 	e.GET("/c/:channel", viewPostsHandler)
 	e.GET("/c/:channel/new", newPostHandler)
 	e.GET("/c/:channel/recent", activityHandler)
+	e.GET("/c/:channel/edit", isLoggedIn(isVerified(channelEditHandler)))
+	e.POST("/c/:channel/edit", isLoggedIn(isVerified(channelEditSubmitHandler)))
+	e.POST("/admin/channels", isLoggedIn(isOperatorUser(channelGrantHandler)))
+}
+
+// channelSidebarContributors is the number of top contributors shown in a channel's sidebar
+const channelSidebarContributors = 5
+
+// channelSidebar defines the channel details shown next to its posts
+type channelSidebar struct {
+	Name         string                // channel name
+	Channel      *schemas.Channel      // channel definition, or nil if nobody has defined the channel yet
+	Subscribers  int                   // number of users subscribed to the channel
+	Moderators   []string              // pubkeys appointed by the channel's creator
+	Contributors []*channelContributor // users with the most karma in the channel
+}
+
+// channelContributor defines a user's karma within a channel
+type channelContributor struct {
+	PubKey string
+	Karma  int
+}
+
+// channelEditHandler serves the form for defining or updating a channel
+func channelEditHandler(c echo.Context) error {
+	channel, err := editableChannel(c)
+	if err != nil {
+		return serveError(c, http.StatusUnauthorized, err)
+	}
+
+	var page struct {
+		Channel    *schemas.Channel
+		Moderators []string
+	}
+	page.Channel = channel
+	page.Moderators = moderatorsForChannel(channel.Name)
+
+	pd := new(pageData).Init(c)
+	pd.Title = "Edit /c/" + channel.Name
+	pd.Page = page
+	return c.Render(http.StatusOK, "base:channel_edit", pd)
+}
+
+// channelEditSubmitHandler publishes a channel definition
+func channelEditSubmitHandler(c echo.Context) error {
+	channel, err := editableChannel(c)
+	if err != nil {
+		return serveError(c, http.StatusUnauthorized, err)
+	}
+
+	// Read form data
+	form := &schemas.Channel{}
+	if err := c.Bind(form); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+	form.Name = channel.Name
+
+	form.Sanitize()
+	if !form.IsValid() {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid channel"))
+	}
+
+	// Claim the channel on this gateway before publishing, so the definition is stored when it comes back from the relays
+	if _, err = claimChannel(channel.Name, c.Get("user").(*schemas.User).PubKey); err != nil {
+		return serveError(c, http.StatusForbidden, err)
+	}
+
+	// Serialize content
+	content, err := json.Marshal(form)
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	// Publish channel definition event
+	_, err = publishEvent(c, content, schemas.KindChannelDefinition, form.Tags())
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	return c.Redirect(http.StatusFound, "/c/"+channel.Name)
+}
+
+// channelGrantHandler assigns a channel to a pubkey on an operator's behalf
+func channelGrantHandler(c echo.Context) error {
+	name := schemas.SanitizeChannel(c.FormValue("channel"))
+	pubkey := strings.ToLower(strings.TrimSpace(c.FormValue("pubkey")))
+	if name == "" || !schemas.IsValidFollow(pubkey) {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid channel or pubkey"))
+	}
+
+	if err := grantChannel(name, pubkey); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	return c.Redirect(http.StatusFound, "/admin")
+}
+
+// editableChannel returns the channel in the request URL if the logged in user may edit it
+// owned channels can only be edited by their owner, and unowned channels claimed by anyone while they're claimable (see claimChannel)
+func editableChannel(c echo.Context) (*schemas.Channel, error) {
+	name := schemas.SanitizeChannel(c.Param("channel"))
+	if name == "" {
+		return nil, errors.New("invalid channel")
+	}
+
+	owner, err := channelOwner(name)
+	if err == nil && owner != c.Get("user").(*schemas.User).PubKey {
+		return nil, errors.New("only the channel's owner can edit it")
+	}
+	if err != nil {
+		if err = channelClaimable(name); err != nil {
+			return nil, err
+		}
+	}
+
+	channel, err := channelForName(name)
+	if err != nil {
+		return &schemas.Channel{Name: name}, nil
+	}
+
+	return channel, nil
+}
+
+// sidebarForChannel returns a channel's definition, subscriber count and top contributors
+func sidebarForChannel(name string) (*channelSidebar, error) {
+	sidebar := &channelSidebar{Name: name}
+	sidebar.Channel, _ = channelForName(name)
+	sidebar.Moderators = moderatorsForChannel(name)
+
+	err := db.QueryRow(`SELECT COUNT(*) FROM subscriptions WHERE channel = ?`, name).Scan(&sidebar.Subscribers)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT pubkey, post_karma + comment_karma AS total FROM karma WHERE channel = ? AND total > 0 ORDER BY total DESC LIMIT ?`, name, channelSidebarContributors)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		contributor := &channelContributor{}
+		err = rows.Scan(&contributor.PubKey, &contributor.Karma)
+		if err != nil {
+			return nil, err
+		}
+		sidebar.Contributors = append(sidebar.Contributors, contributor)
+	}
+
+	return sidebar, rows.Err()
+}
+
+// channelForName queries the DB and returns a channel's definition
+func channelForName(name string) (*schemas.Channel, error) {
+	channel := &schemas.Channel{}
+	err := db.QueryRow(`SELECT name, creator, created_at, updated_at, description, rules, banner, nsfw FROM channels WHERE name = ?`, name).Scan(
+		&channel.Name, &channel.Creator, &channel.CreatedAt, &channel.UpdatedAt, &channel.Description, &channel.Rules, &channel.Banner, &channel.NSFW,
+	)
+	if err != nil {
+		return nil, err
+	}
+	channel.Flair = channelFlair(name)
+
+	return channel, nil
+}
+
+// channelOwners holds the channel owners file open for appending claims and grants
+var channelOwners = struct {
+	sync.Mutex
+	file *os.File
+}{}
+
+// loadChannelOwners reads the channel owners file into the DB and opens it for appending claims and grants
+// each line holds a channel name and its owner's pubkey, separated by whitespace. later lines override earlier ones,
+// so operators can also reassign a channel by appending a line and restarting the gateway
+func loadChannelOwners() {
+	if appConfig.ChannelOwnersFile == "" {
+		return
+	}
+
+	file, err := os.OpenFile(appConfig.ChannelOwnersFile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		panic("unable to open channel owners file: " + err.Error())
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != schemas.SanitizeChannel(fields[0]) {
+			continue
+		}
+		_, err = db.Exec(`INSERT INTO channel_owners(channel, pubkey) VALUES(?,?) ON CONFLICT (channel) DO UPDATE SET pubkey=excluded.pubkey`, fields[0], fields[1])
+		checkErr.Panic(err)
+		count++
+	}
+
+	channelOwners.file = file
+	log.Printf("loaded %d channel owners\n", count)
+}
+
+// channelOwner queries the DB and returns the pubkey that owns a channel
+func channelOwner(name string) (string, error) {
+	var owner string
+	err := db.QueryRow(`SELECT pubkey FROM channel_owners WHERE channel = ?`, name).Scan(&owner)
+	return owner, err
+}
+
+// channelClaimable returns an error if an unowned channel can't be claimed by a user
+// channels that already have posts are part of the community that posted them, so only an operator can assign them (see grantChannel)
+func channelClaimable(name string) error {
+	// A channel's posts may not have arrived yet
+	if !caughtUp() {
+		return errors.New("channels can't be claimed until the gateway has caught up with the relays. try again in a few minutes")
+	}
+
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM posts WHERE channel = ?`, name).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("this channel already has posts. ask the gateway's operators to assign it to you")
+	}
+
+	return nil
+}
+
+// claimChannel returns a channel's owner, assigning an unowned channel without posts to the supplied pubkey
+// ownership is only ever decided on this gateway, when a user claims a channel or an operator grants one, and kept in the
+// channel owners file. channel definitions arriving from the relays never claim a channel, however they're dated
+func claimChannel(name string, pubkey string) (string, error) {
+	channelOwners.Lock()
+	defer channelOwners.Unlock()
+
+	if owner, err := channelOwner(name); err == nil {
+		return owner, nil
+	}
+
+	if err := channelClaimable(name); err != nil {
+		return "", err
+	}
+
+	if err := setChannelOwner(name, pubkey); err != nil {
+		return "", err
+	}
+
+	return pubkey, nil
+}
+
+// grantChannel assigns a channel to a pubkey, replacing any existing owner
+func grantChannel(name string, pubkey string) error {
+	channelOwners.Lock()
+	defer channelOwners.Unlock()
+
+	return setChannelOwner(name, pubkey)
+}
+
+// setChannelOwner records a channel's owner in the DB and the channel owners file
+// callers hold channelOwners' lock
+func setChannelOwner(name string, pubkey string) error {
+	_, err := db.Exec(`INSERT INTO channel_owners(channel, pubkey) VALUES(?,?) ON CONFLICT (channel) DO UPDATE SET pubkey=excluded.pubkey`, name, pubkey)
+	if err != nil {
+		return err
+	}
+	if channelOwners.file != nil {
+		fmt.Fprintf(channelOwners.file, "%s %s\n", name, pubkey)
+	}
+
+	return nil
+}
+
+// upsertChannel stores a channel definition in the DB
+// only definitions from the channel's owner are stored, and an ingested event never changes the owner (see claimChannel)
+func upsertChannel(channel *schemas.Channel) error {
+	owner, err := channelOwner(channel.Name)
+	if err != nil {
+		return errors.New("channel isn't owned on this gateway")
+	}
+	if channel.Creator != owner {
+		return errors.New("only the channel's owner can update it")
+	}
+
+	existing, err := channelForName(channel.Name)
+	if err == nil {
+		if channel.UpdatedAt <= existing.UpdatedAt {
+			// An older definition can still move the creation time back
+			_, err = db.Exec(`UPDATE channels SET created_at = MIN(created_at, ?) WHERE name = ?`, channel.CreatedAt, channel.Name)
+			if err != nil {
+				return err
+			}
+			return errors.New("channel definition is outdated")
+		}
+		channel.CreatedAt = existing.CreatedAt
+	}
+
+	_, err = db.Exec(`INSERT INTO channels(name, creator, created_at, updated_at, description, rules, banner, nsfw) VALUES(?,?,?,?,?,?,?,?)
+		ON CONFLICT (name) DO UPDATE SET created_at=excluded.created_at, updated_at=excluded.updated_at,
+		description=excluded.description, rules=excluded.rules, banner=excluded.banner, nsfw=excluded.nsfw`,
+		channel.Name, channel.Creator, channel.CreatedAt, channel.UpdatedAt, channel.Description, channel.Rules, channel.Banner, channel.NSFW)
+	if err != nil {
+		return err
+	}
+
+	return upsertChannelFlair(channel)
 }
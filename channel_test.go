@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClaimChannel(t *testing.T) {
+	owner := strings.Repeat("1", 64)
+	other := strings.Repeat("2", 64)
+	defer db.Exec(`DELETE FROM channel_owners WHERE channel IN ('claimtest', 'claimposts')`)
+	defer db.Exec(`DELETE FROM posts WHERE channel = 'claimposts'`)
+
+	// Nothing can be claimed while the gateway is still catching up with the relays
+	if _, err := claimChannel("claimtest", owner); err == nil {
+		t.Fatal("channel claimed right after starting")
+	}
+
+	saved := adminState.startedAt
+	adminState.startedAt = uint32(time.Now().Add(-relayCatchUpDelay).Unix())
+	defer func() { adminState.startedAt = saved }()
+
+	// The first claim on an empty channel wins, and later claims get the existing owner
+	if got, err := claimChannel("claimtest", owner); err != nil || got != owner {
+		t.Fatalf("claimChannel on an empty channel = %q, %v", got, err)
+	}
+	if got, err := claimChannel("claimtest", other); err != nil || got != owner {
+		t.Fatalf("second claimChannel = %q, %v, want the first owner", got, err)
+	}
+
+	// Channels with posts can't be claimed, only granted
+	post := testPost(101, other, 1000, "existing", "an existing post")
+	post.Channel = "claimposts"
+	if err := insertPost(post); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := claimChannel("claimposts", owner); err == nil {
+		t.Fatal("channel with posts claimed")
+	}
+	if err := grantChannel("claimposts", owner); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := channelOwner("claimposts"); got != owner {
+		t.Fatalf("granted channel owned by %q", got)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+const (
+	// chartWidth and chartHeight are the SVG viewBox dimensions for charts
+	chartWidth  = 600
+	chartHeight = 200
+	// chartPadding leaves room around the plot for axis labels
+	chartPadding = 20
+	// sparklineWidth and sparklineHeight are the SVG viewBox dimensions for sparklines
+	sparklineWidth  = 200
+	sparklineHeight = 40
+)
+
+// voteTimelineSVG renders vote buckets as an SVG bar chart
+// upvotes are drawn above the axis, downvotes below, and the running score as a line
+func voteTimelineSVG(buckets []*voteBucket, size uint32) template.HTML {
+	if len(buckets) == 0 {
+		return ""
+	}
+
+	// Scale bars so the busiest bucket fills half the plot
+	maxVotes := 1
+	for _, bucket := range buckets {
+		if bucket.Up > maxVotes {
+			maxVotes = bucket.Up
+		}
+		if bucket.Down > maxVotes {
+			maxVotes = bucket.Down
+		}
+	}
+
+	// Scale the running score line separately
+	maxScore := 1
+	score := 0
+	for _, bucket := range buckets {
+		score += bucket.Up - bucket.Down
+		if score > maxScore {
+			maxScore = score
+		}
+		if -score > maxScore {
+			maxScore = -score
+		}
+	}
+
+	plotWidth := float64(chartWidth - 2*chartPadding)
+	halfHeight := float64(chartHeight-2*chartPadding) / 2
+	axis := float64(chartPadding) + halfHeight
+	barWidth := plotWidth / float64(len(buckets))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="chart" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg" role="img">`, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<line class="chart-axis" x1="%d" y1="%.1f" x2="%d" y2="%.1f"/>`, chartPadding, axis, chartWidth-chartPadding, axis)
+
+	var points []string
+	score = 0
+	for i, bucket := range buckets {
+		x := float64(chartPadding) + float64(i)*barWidth
+		up := float64(bucket.Up) / float64(maxVotes) * halfHeight
+		down := float64(bucket.Down) / float64(maxVotes) * halfHeight
+
+		fmt.Fprintf(&b, `<g><title>%s: +%d / -%d</title>`, formatChartTime(bucket.Start, size), bucket.Up, bucket.Down)
+		fmt.Fprintf(&b, `<rect class="chart-hover" x="%.1f" y="%d" width="%.1f" height="%d"/>`, x, chartPadding, barWidth, chartHeight-2*chartPadding)
+		if bucket.Up > 0 {
+			fmt.Fprintf(&b, `<rect class="chart-up" x="%.1f" y="%.1f" width="%.1f" height="%.1f"/>`, x+1, axis-up, barWidth-2, up)
+		}
+		if bucket.Down > 0 {
+			fmt.Fprintf(&b, `<rect class="chart-down" x="%.1f" y="%.1f" width="%.1f" height="%.1f"/>`, x+1, axis, barWidth-2, down)
+		}
+		b.WriteString(`</g>`)
+
+		score += bucket.Up - bucket.Down
+		y := axis - float64(score)/float64(maxScore)*halfHeight
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x+barWidth/2, y))
+	}
+
+	fmt.Fprintf(&b, `<polyline class="chart-line" points="%s"/>`, strings.Join(points, " "))
+
+	// Label the start and end of the timeline
+	end := buckets[len(buckets)-1].Start + size
+	fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, chartPadding, chartHeight-4, formatChartTime(buckets[0].Start, size))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartWidth-chartPadding, chartHeight-4, formatChartTime(end, size))
+	fmt.Fprintf(&b, `<text x="%d" y="%d">max %d votes per %s</text>`, chartPadding, chartPadding-6, maxVotes, formatDuration(size))
+
+	b.WriteString(`</svg>`)
+
+	// All interpolated values are numbers or formatted timestamps, so the markup is safe to render
+	return template.HTML(b.String())
+}
+
+// sparklineSVG renders a series of values as a small SVG line chart, with a dashed line marking zero when it's in range
+func sparklineSVG(values []int) template.HTML {
+	if len(values) == 0 {
+		return ""
+	}
+
+	min, max := 0, 0
+	for i, value := range values {
+		if i == 0 || value < min {
+			min = value
+		}
+		if i == 0 || value > max {
+			max = value
+		}
+	}
+	if max == min {
+		max = min + 1
+	}
+
+	// Leave a pixel at the top and bottom so the line isn't clipped
+	scale := float64(sparklineHeight-2) / float64(max-min)
+	step := float64(sparklineWidth)
+	if len(values) > 1 {
+		step = float64(sparklineWidth) / float64(len(values)-1)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="sparkline" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg" role="img">`, sparklineWidth, sparklineHeight)
+	fmt.Fprintf(&b, `<title>%d to %d</title>`, values[0], values[len(values)-1])
+	if min < 0 && max > 0 {
+		zero := float64(sparklineHeight-1) - float64(-min)*scale
+		fmt.Fprintf(&b, `<line class="sparkline-zero" x1="0" y1="%.1f" x2="%d" y2="%.1f"/>`, zero, sparklineWidth, zero)
+	}
+
+	points := make([]string, len(values))
+	for i, value := range values {
+		points[i] = fmt.Sprintf("%.1f,%.1f", float64(i)*step, float64(sparklineHeight-1)-float64(value-min)*scale)
+	}
+	fmt.Fprintf(&b, `<polyline class="chart-line" points="%s"/>`, strings.Join(points, " "))
+
+	b.WriteString(`</svg>`)
+
+	// All interpolated values are numbers, so the markup is safe to render
+	return template.HTML(b.String())
+}
+
+// formatChartTime formats a chart timestamp in UTC, dropping the time of day for day-sized buckets
+func formatChartTime(ts uint32, size uint32) string {
+	t := time.Unix(int64(ts), 0).UTC()
+	if size >= 86400 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// formatDuration formats a number of seconds as its two largest units, e.g. "5m", "3h 20m" or "2d 4h"
+func formatDuration(seconds uint32) string {
+	days, hours, minutes := seconds/86400, seconds%86400/3600, seconds%3600/60
+	switch {
+	case days > 0 && hours > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case days > 0:
+		return fmt.Sprintf("%dd", days)
+	case hours > 0 && minutes > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh", hours)
+	case minutes > 0:
+		return fmt.Sprintf("%dm", minutes)
+	default:
+		return "<1m"
+	}
+}
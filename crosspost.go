@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// crosspostRoutes sets up crosspost routes
+func crosspostRoutes(e *echo.Echo) {
+	e.GET("/p/:id/crosspost", isLoggedIn(isVerified(newPostHandler)))
+}
+
+// duplicateLinksLimit caps the number of earlier submissions shown when a link is submitted again
+const duplicateLinksLimit = 5
+
+// crosspostOrigin returns the original post a post crossposts, following crossposts of crossposts back to the original
+func crosspostOrigin(id string) (*schemas.Post, error) {
+	// Guard against loops between crossposts
+	for i := 0; i < 10; i++ {
+		post, err := getPost(id)
+		if err != nil {
+			return nil, err
+		}
+		if post.Parent != "" {
+			return nil, errors.New("only top-level posts can be crossposted")
+		}
+		if post.Crosspost == "" {
+			return post, nil
+		}
+		id = post.Crosspost
+	}
+
+	return nil, errors.New("too many nested crossposts")
+}
+
+// verifyCrosspost checks an incoming crosspost against its original before it's stored, and returns the original's ID if it hasn't arrived yet
+// a crosspost has to carry its original's body to another channel. ones that don't are stored as ordinary posts, so they're still
+// checked for duplicate links and listed under their domain. a crosspost whose original is missing is stored as an ordinary post too,
+// with its claim kept in the pending_crosspost column until the original arrives (see confirmCrossposts)
+func verifyCrosspost(post *schemas.Post) string {
+	id := post.Crosspost
+	post.Crosspost = ""
+	if id == "" || post.Parent != "" {
+		return ""
+	}
+
+	original, err := getPost(id)
+	if err != nil {
+		return id
+	}
+	if isCrosspostOf(post, original) {
+		post.Crosspost = id
+	}
+
+	return ""
+}
+
+// confirmCrossposts turns pending crossposts of a newly stored post into crossposts, if they match it
+func confirmCrossposts(original *schemas.Post) error {
+	if original.Parent == "" && original.Crosspost == "" {
+		_, err := db.Exec(`UPDATE posts SET crosspost = pending_crosspost WHERE pending_crosspost = ? AND body = ? AND channel != ?`, original.ID, original.Body, original.Channel)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(`UPDATE posts SET pending_crosspost = '' WHERE pending_crosspost = ?`, original.ID)
+	return err
+}
+
+// isCrosspostOf returns true if a post carries an original post's body to another channel
+func isCrosspostOf(post *schemas.Post, original *schemas.Post) bool {
+	return original.Parent == "" && original.Crosspost == "" && original.Body == post.Body && original.Channel != post.Channel
+}
+
+// duplicateLinks queries the DB and returns earlier top-level posts linking to the same canonical URL as a new post, highest scoring first
+// crossposts aren't included, since they point back to a post that is
+func duplicateLinks(post *schemas.Post) []*schemas.Post {
+	var posts []*schemas.Post
+	if post.Parent != "" || post.Crosspost != "" {
+		return posts
+	}
+	link := canonicalURL(post.Body)
+	if link == "" {
+		return posts
+	}
+
+	rows, err := db.Query(`SELECT id, score, children, pubkey, created_at, title, channel FROM posts
+		WHERE parent = '' AND crosspost = '' AND link = ?`+hiddenStmt+removedStmt+` ORDER BY score DESC LIMIT ?`, link, duplicateLinksLimit)
+	if err != nil {
+		return posts
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := &schemas.Post{}
+		if rows.Scan(&p.ID, &p.Score, &p.Children, &p.PubKey, &p.CreatedAt, &p.Title, &p.Channel) == nil {
+			posts = append(posts, p)
+		}
+	}
+
+	return posts
+}
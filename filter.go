@@ -0,0 +1,563 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/rdbell/nvote/schemas"
+)
+
+const (
+	// filterStageIngest filters run once when a post arrives from the relays
+	filterStageIngest = "ingest"
+	// filterStageRender filters are matched at ingest and applied whenever the post is displayed
+	filterStageRender = "render"
+)
+
+const (
+	// filterActionAccept accepts a post, skipping the remaining ingest filters
+	filterActionAccept = "accept"
+	// filterActionReject drops a post
+	filterActionReject = "reject"
+	// filterActionFlag records a post for the operator without changing how it's displayed
+	filterActionFlag = "flag"
+	// filterActionHide removes a post from listings and threads
+	filterActionHide = "hide"
+	// filterActionCollapse collapses a comment in threads and labels it in listings
+	filterActionCollapse = "collapse"
+	// filterActionLabel shows a label next to a post
+	filterActionLabel = "label"
+)
+
+const (
+	// filterTypeKeywords matches posts containing any of a list of words or phrases
+	filterTypeKeywords = "keywords"
+	// filterTypeRegex matches posts against a list of regular expressions
+	filterTypeRegex = "regex"
+	// filterTypeDomains matches posts linking to blocklisted domains
+	filterTypeDomains = "domains"
+	// filterTypeDuplicates matches posts that repeat a recent post
+	filterTypeDuplicates = "duplicates"
+	// filterTypeRate matches posts from pubkeys posting too often
+	filterTypeRate = "rate"
+)
+
+// contentFilter decides whether a post matches
+type contentFilter interface {
+	Match(post *schemas.Post) bool
+}
+
+// relatedFilter is a content filter that compares a post with earlier posts
+// posts don't arrive from the relays in order, so a post arriving late can make later posts match too.
+// at the render stage and for ingest flags, those matches are recorded on the later posts. ingest accepts and rejects are
+// decided when a post arrives, against the earlier posts stored by then
+type relatedFilter interface {
+	contentFilter
+	Later(post *schemas.Post) []*schemas.Post // posts that may match now that this post is stored
+}
+
+// filterStage defines one configured step of the content filter pipeline
+type filterStage struct {
+	filter contentFilter
+	stage  string
+	action string
+	label  string
+}
+
+// postFlag defines a filter match recorded against a post
+type postFlag struct {
+	Stage  string
+	Action string
+	Label  string
+}
+
+// contentFilters is the content filter pipeline configured for this gateway, in order
+var contentFilters []*filterStage
+
+// indexShingles is set when a duplicates filter needs the MinHash index of posts
+var indexShingles bool
+
+// initContentFilters sets up the content filter pipeline from the app config
+func initContentFilters() {
+	contentFilters = nil
+	indexShingles = false
+
+	for i, config := range appConfig.ContentFilters {
+		stage := &filterStage{
+			stage:  config.Stage,
+			action: config.Action,
+			label:  config.Label,
+		}
+		if stage.label == "" {
+			stage.label = config.Type
+		}
+
+		switch config.Stage {
+		case filterStageIngest:
+			if config.Action != filterActionAccept && config.Action != filterActionReject && config.Action != filterActionFlag {
+				panic(fmt.Sprintf("content filter %d: invalid ingest action: %s", i, config.Action))
+			}
+		case filterStageRender:
+			if config.Action != filterActionHide && config.Action != filterActionCollapse && config.Action != filterActionLabel {
+				panic(fmt.Sprintf("content filter %d: invalid render action: %s", i, config.Action))
+			}
+		default:
+			panic(fmt.Sprintf("content filter %d: invalid stage: %s", i, config.Stage))
+		}
+
+		window := uint32(config.WindowSeconds)
+		if window == 0 {
+			window = 86400
+		}
+
+		switch config.Type {
+		case filterTypeKeywords:
+			stage.filter = newKeywordFilter(config.Keywords)
+		case filterTypeRegex:
+			stage.filter = newRegexFilter(config.Patterns)
+		case filterTypeDomains:
+			stage.filter = newDomainFilter(config.Domains)
+		case filterTypeDuplicates:
+			similarity := config.Similarity
+			if similarity <= 0 || similarity > 1 {
+				similarity = 1
+			}
+			stage.filter = &duplicateFilter{similarity: similarity, window: window}
+			indexShingles = true
+		case filterTypeRate:
+			if config.MaxPosts <= 0 {
+				panic(fmt.Sprintf("content filter %d: rate filter needs max_posts", i))
+			}
+			stage.filter = &rateFilter{maxPosts: config.MaxPosts, window: window}
+		default:
+			panic(fmt.Sprintf("content filter %d: unknown type: %s", i, config.Type))
+		}
+
+		contentFilters = append(contentFilters, stage)
+	}
+}
+
+// filterPost runs a post through the content filter pipeline
+// returns false if the post should be dropped, along with flags to record against accepted posts
+func filterPost(post *schemas.Post) (bool, []*postFlag) {
+	var flags []*postFlag
+	accepted := false
+
+	for _, stage := range contentFilters {
+		// An ingest "accept" skips the remaining ingest filters, but render filters still apply
+		if accepted && stage.stage == filterStageIngest {
+			continue
+		}
+		if !stage.filter.Match(post) {
+			continue
+		}
+
+		switch stage.action {
+		case filterActionAccept:
+			accepted = true
+		case filterActionReject:
+			return false, nil
+		case filterActionFlag:
+			log.Printf("content filter %q flagged post %s\n", stage.label, post.ID)
+			flags = append(flags, &postFlag{Stage: stage.stage, Action: stage.action, Label: stage.label})
+		default:
+			flags = append(flags, &postFlag{Stage: stage.stage, Action: stage.action, Label: stage.label})
+		}
+	}
+
+	return true, flags
+}
+
+// insertPostFlags records content filter matches for a post
+func insertPostFlags(id string, flags []*postFlag) {
+	for _, flag := range flags {
+		db.Exec(`INSERT INTO post_flags(post_id, stage, action, label) SELECT ?1, ?2, ?3, ?4
+			WHERE NOT EXISTS (SELECT 1 FROM post_flags WHERE post_id = ?1 AND stage = ?2 AND action = ?3 AND label = ?4)`, id, flag.Stage, flag.Action, flag.Label)
+	}
+}
+
+// filterLaterPosts indexes a newly stored post for the related filters, and records matches on later posts it causes
+// a match only ever depends on earlier posts, so the flags end up the same whatever order posts arrive in
+func filterLaterPosts(post *schemas.Post) {
+	if indexShingles {
+		insertPostShingles(post)
+	}
+
+	for _, stage := range contentFilters {
+		related, ok := stage.filter.(relatedFilter)
+		if !ok {
+			continue
+		}
+
+		// Stored posts can't be accepted or rejected again. only flags and render matches are recorded
+		if stage.action == filterActionAccept || stage.action == filterActionReject {
+			continue
+		}
+		for _, later := range related.Later(post) {
+			if related.Match(later) {
+				insertPostFlags(later.ID, []*postFlag{{Stage: stage.stage, Action: stage.action, Label: stage.label}})
+			}
+		}
+	}
+}
+
+// hiddenStmt is a SQL condition excluding posts hidden by the content filters or by the gateway's operators
+const hiddenStmt = " AND posts.id NOT IN (SELECT post_id FROM post_flags WHERE action = 'hide')" +
+	" AND posts.id NOT IN (SELECT target FROM gateway_hidden_posts) AND posts.pubkey NOT IN (SELECT target FROM gateway_hidden_users)" +
+	blockedStmt
+
+// isHidden returns true if the content filters or the gateway's operators hide a post
+func isHidden(id string) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM post_flags WHERE post_id = ? AND action = ?`, id, filterActionHide).Scan(&count)
+	if count > 0 {
+		return true
+	}
+
+	db.QueryRow(`SELECT COUNT(*) FROM posts WHERE id = ? AND (id IN (SELECT target FROM gateway_hidden_posts) OR pubkey IN (SELECT target FROM gateway_hidden_users))`, id).Scan(&count)
+	if count > 0 {
+		return true
+	}
+
+	_, blocked := blockedPostReason(id)
+	return blocked
+}
+
+// labelPosts fills the labels and collapsed state of a page's posts from their render filter matches
+func labelPosts(posts []*schemas.Post) {
+	if len(contentFilters) == 0 {
+		return
+	}
+
+	byID, in, args := postsByID(posts)
+	rows, err := db.Query(`SELECT post_id, action, label FROM post_flags WHERE stage = ? AND post_id IN (`+in+`) ORDER BY rowid`, append([]interface{}{filterStageRender}, args...)...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, action, label string
+		if rows.Scan(&id, &action, &label) != nil {
+			continue
+		}
+		for _, post := range byID[id] {
+			if action == filterActionCollapse {
+				post.Collapsed = true
+			}
+			post.Labels = append(post.Labels, label)
+		}
+	}
+}
+
+// postText returns a post's title and body, lowercased for matching
+func postText(post *schemas.Post) string {
+	return strings.ToLower(post.Title + "\n" + post.Body)
+}
+
+// keywordFilter matches posts containing any of a list of words or phrases
+type keywordFilter struct {
+	keywords []string
+}
+
+// newKeywordFilter returns a keyword filter for a list of case-insensitive keywords
+func newKeywordFilter(keywords []string) *keywordFilter {
+	f := &keywordFilter{}
+	for _, keyword := range keywords {
+		keyword = strings.ToLower(strings.TrimSpace(keyword))
+		if keyword != "" {
+			f.keywords = append(f.keywords, keyword)
+		}
+	}
+	return f
+}
+
+// Match checks a post's title and body for the keywords
+func (f *keywordFilter) Match(post *schemas.Post) bool {
+	text := postText(post)
+	for _, keyword := range f.keywords {
+		if strings.Contains(text, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// regexFilter matches posts against a list of regular expressions
+type regexFilter struct {
+	patterns []*regexp.Regexp
+}
+
+// newRegexFilter compiles a list of patterns into a regex filter
+func newRegexFilter(patterns []string) *regexFilter {
+	f := &regexFilter{}
+	for _, pattern := range patterns {
+		f.patterns = append(f.patterns, regexp.MustCompile(pattern))
+	}
+	return f
+}
+
+// Match checks a post's title and body against the patterns
+func (f *regexFilter) Match(post *schemas.Post) bool {
+	text := post.Title + "\n" + post.Body
+	for _, pattern := range f.patterns {
+		if pattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkRegexp finds links in post titles and bodies
+var linkRegexp = regexp.MustCompile(`(?i)https?://[^\s<>()\[\]"']+`)
+
+// domainFilter matches posts linking to any of a list of domains or their subdomains
+type domainFilter struct {
+	domains []string
+}
+
+// newDomainFilter returns a domain filter for a list of domains
+func newDomainFilter(domains []string) *domainFilter {
+	f := &domainFilter{}
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "www.")
+		if domain != "" {
+			f.domains = append(f.domains, domain)
+		}
+	}
+	return f
+}
+
+// Match checks the hosts of a post's links against the blocklist
+func (f *domainFilter) Match(post *schemas.Post) bool {
+	for _, link := range linkRegexp.FindAllString(post.Title+"\n"+post.Body, -1) {
+		u, err := url.Parse(link)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		for _, domain := range f.domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// duplicateFilter matches posts that repeat an earlier post within a time window
+type duplicateFilter struct {
+	similarity float64
+	window     uint32
+}
+
+// duplicateScanLimit caps how many candidate posts a post is compared with
+const duplicateScanLimit = 1000
+
+const (
+	// minhashBands and minhashRows size the MinHash index used to find near-duplicate candidates
+	// posts sharing any band are compared word by word. two rows per band finds nearly all pairs above 50% similarity
+	minhashBands = 8
+	minhashRows  = 2
+)
+
+// wordRegexp splits post text into words for duplicate detection
+var wordRegexp = regexp.MustCompile(`[\pL\pN]+`)
+
+// Match compares a post's words with earlier posts in the window that share a MinHash band with it
+func (f *duplicateFilter) Match(post *schemas.Post) bool {
+	words := wordSet(postText(post))
+	if len(words) == 0 {
+		return false
+	}
+
+	since := uint32(0)
+	if post.CreatedAt > f.window {
+		since = post.CreatedAt - f.window
+	}
+
+	for _, other := range similarPosts(post, since, post.CreatedAt) {
+		if postBefore(other, post) && jaccard(words, wordSet(postText(other))) >= f.similarity {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Later returns the posts in the window after a post that share a MinHash band with it
+func (f *duplicateFilter) Later(post *schemas.Post) []*schemas.Post {
+	var later []*schemas.Post
+	for _, other := range similarPosts(post, post.CreatedAt, post.CreatedAt+f.window) {
+		if postBefore(post, other) {
+			later = append(later, other)
+		}
+	}
+	return later
+}
+
+// similarPosts queries the DB and returns posts created within a time range that share a MinHash band with a post
+func similarPosts(post *schemas.Post, since uint32, until uint32) []*schemas.Post {
+	var posts []*schemas.Post
+
+	bands := minhashBandHashes(wordSet(postText(post)))
+	if len(bands) == 0 {
+		return posts
+	}
+
+	var conditions []string
+	var args []interface{}
+	for band, hash := range bands {
+		conditions = append(conditions, "(band = ? AND hash = ?)")
+		args = append(args, band, hash)
+	}
+	args = append(args, since, until, post.ID, duplicateScanLimit)
+
+	rows, err := db.Query(`SELECT id, pubkey, created_at, title, body FROM posts WHERE id IN (
+		SELECT post_id FROM post_shingles WHERE (`+strings.Join(conditions, " OR ")+`) AND created_at >= ? AND created_at <= ? AND post_id != ?
+	) LIMIT ?`, args...)
+	if err != nil {
+		return posts
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		other := &schemas.Post{}
+		if rows.Scan(&other.ID, &other.PubKey, &other.CreatedAt, &other.Title, &other.Body) == nil {
+			posts = append(posts, other)
+		}
+	}
+
+	return posts
+}
+
+// insertPostShingles indexes a post's MinHash bands for the duplicates filter
+func insertPostShingles(post *schemas.Post) {
+	for band, hash := range minhashBandHashes(wordSet(postText(post))) {
+		db.Exec(`INSERT INTO post_shingles(post_id, band, hash, created_at) VALUES(?,?,?,?)`, post.ID, band, hash, post.CreatedAt)
+	}
+}
+
+// minhashBandHashes returns the MinHash band hashes of a word set
+// the more words two sets share, the more likely they are to have a band in common. identical sets have every band in common
+func minhashBandHashes(words map[string]bool) []int64 {
+	if len(words) == 0 {
+		return nil
+	}
+
+	mins := make([]uint64, minhashBands*minhashRows)
+	for i := range mins {
+		mins[i] = math.MaxUint64
+	}
+	for word := range words {
+		h := fnv.New64a()
+		h.Write([]byte(word))
+		base := h.Sum64()
+		for i := range mins {
+			if v := mix64(base ^ uint64(i+1)*0x9e3779b97f4a7c15); v < mins[i] {
+				mins[i] = v
+			}
+		}
+	}
+
+	bands := make([]int64, minhashBands)
+	for band := range bands {
+		v := uint64(band)
+		for row := 0; row < minhashRows; row++ {
+			v = mix64(v ^ mins[band*minhashRows+row])
+		}
+		// SQLite integers are signed
+		bands[band] = int64(v)
+	}
+
+	return bands
+}
+
+// mix64 scrambles the bits of a 64-bit value (the splitmix64 finalizer)
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// wordSet returns the distinct words in a string
+func wordSet(text string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range wordRegexp.FindAllString(text, -1) {
+		words[word] = true
+	}
+	return words
+}
+
+// jaccard returns the overlap between two word sets, from 0 (nothing shared) to 1 (identical)
+func jaccard(a map[string]bool, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for word := range a {
+		if b[word] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// rateFilter matches posts from pubkeys that have posted too often within a time window
+type rateFilter struct {
+	maxPosts int
+	window   uint32
+}
+
+// Match counts the pubkey's earlier posts and comments within the window
+func (f *rateFilter) Match(post *schemas.Post) bool {
+	since := uint32(0)
+	if post.CreatedAt > f.window {
+		since = post.CreatedAt - f.window
+	}
+
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM posts WHERE pubkey = ? AND created_at >= ? AND (created_at < ? OR (created_at = ? AND id < ?))`,
+		post.PubKey, since, post.CreatedAt, post.CreatedAt, post.ID).Scan(&count)
+
+	return count >= f.maxPosts
+}
+
+// Later returns the pubkey's posts and comments in the window after a post
+func (f *rateFilter) Later(post *schemas.Post) []*schemas.Post {
+	var posts []*schemas.Post
+
+	rows, err := db.Query(`SELECT id, pubkey, created_at, title, body FROM posts WHERE pubkey = ? AND created_at <= ? AND (created_at > ? OR (created_at = ? AND id > ?))`,
+		post.PubKey, post.CreatedAt+f.window, post.CreatedAt, post.CreatedAt, post.ID)
+	if err != nil {
+		return posts
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		other := &schemas.Post{}
+		if rows.Scan(&other.ID, &other.PubKey, &other.CreatedAt, &other.Title, &other.Body) == nil {
+			posts = append(posts, other)
+		}
+	}
+
+	return posts
+}
+
+// postBefore orders posts by creation time, breaking ties by ID, so which of two posts came first doesn't depend on the order they arrive in
+func postBefore(a *schemas.Post, b *schemas.Post) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt < b.CreatedAt
+	}
+	return a.ID < b.ID
+}
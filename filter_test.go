@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rdbell/nvote/schemas"
+)
+
+// testPost returns a post with a unique ID for the filter tests
+func testPost(n int, pubkey string, createdAt uint32, title string, body string) *schemas.Post {
+	return &schemas.Post{
+		ID:        fmt.Sprintf("%064x", 0xf117e400+n),
+		PubKey:    pubkey,
+		Channel:   "filtertest",
+		CreatedAt: createdAt,
+		Title:     title,
+		Body:      body,
+	}
+}
+
+func TestIngestRelatedFilters(t *testing.T) {
+	saved := appConfig.ContentFilters
+	defer func() {
+		appConfig.ContentFilters = saved
+		initContentFilters()
+	}()
+
+	appConfig.ContentFilters = []*schemas.ContentFilterConfig{
+		{Type: filterTypeDuplicates, Stage: filterStageIngest, Action: filterActionReject, WindowSeconds: 3600},
+		{Type: filterTypeRate, Stage: filterStageIngest, Action: filterActionReject, MaxPosts: 2, WindowSeconds: 3600},
+	}
+	initContentFilters()
+
+	spammer := strings.Repeat("c", 64)
+	other := strings.Repeat("d", 64)
+	defer db.Exec(`DELETE FROM posts WHERE pubkey IN (?,?)`, spammer, other)
+	defer db.Exec(`DELETE FROM post_shingles WHERE post_id IN (SELECT id FROM posts WHERE pubkey IN (?,?))`, spammer, other)
+
+	ingest := func(post *schemas.Post) bool {
+		accepted, _ := filterPost(post)
+		if accepted {
+			if err := insertPost(post); err != nil {
+				t.Fatal(err)
+			}
+			filterLaterPosts(post)
+		}
+		return accepted
+	}
+
+	if !ingest(testPost(1, other, 1000, "original", "the quick brown fox jumps over the lazy dog")) {
+		t.Fatal("first post rejected")
+	}
+	if ingest(testPost(2, spammer, 1100, "original", "the quick brown fox jumps over the lazy dog")) {
+		t.Error("duplicate post accepted at ingest")
+	}
+
+	if !ingest(testPost(3, spammer, 1200, "one", "first distinct post")) || !ingest(testPost(4, spammer, 1300, "two", "second distinct post")) {
+		t.Fatal("posts under the rate limit rejected")
+	}
+	if ingest(testPost(5, spammer, 1400, "three", "third distinct post")) {
+		t.Error("post over the rate limit accepted at ingest")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rdbell/go-nostr"
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// followRoutes sets up follow-related routes
+func followRoutes(e *echo.Echo) {
+	e.GET("/following", isLoggedIn(followingHandler))
+	e.POST("/follow", isLoggedIn(followSubmitHandler))
+}
+
+// followForm defines a follow/unfollow request
+type followForm struct {
+	PubKey   string `form:"pubkey"`   // pubkey to follow
+	Unfollow bool   `form:"unfollow"` // remove the pubkey from the contact list instead of adding it
+}
+
+// followingHandler serves posts and comments from the pubkeys the logged in user follows
+func followingHandler(c echo.Context) error {
+	var page struct {
+		Posts     []*schemas.Post
+		Page      int
+		Follows   int
+		UserVotes []*schemas.Vote
+	}
+
+	page.Page, _ = strconv.Atoi(c.FormValue("page"))
+
+	// Sanitize page number
+	if page.Page < 0 {
+		page.Page = 0
+	}
+
+	pubkey := c.Get("user").(*schemas.User).PubKey
+	contactList, _ := contactListForPubkey(pubkey)
+	page.Follows = len(contactList.Values(schemas.FollowTag))
+
+	// Fetch posts and comments ordered by ranking
+	var err error
+	page.Posts, err = fetchPosts(userFilters(c, &schemas.PostFilterset{
+		PostType:      schemas.PostTypeAll,
+		FollowedBy:    pubkey,
+		Page:          page.Page,
+		OrderByColumn: "ranking",
+		Limit:         appConfig.PostsPerPage,
+	}))
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	// Fetch all votes for this user, to disable votes for posts that have already been voted on
+	page.UserVotes, err = fetchVotes(&schemas.VoteFilterset{
+		PubKey: pubkey,
+		// TODO: add limit?
+	})
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	pd := new(pageData).Init(c)
+	pd.Title = "Following"
+	pd.Page = page
+	return c.Render(http.StatusOK, "base:following", pd)
+}
+
+// followSubmitHandler adds or removes a pubkey on the user's contact list and republishes it
+func followSubmitHandler(c echo.Context) error {
+	form := &followForm{}
+	if err := c.Bind(form); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	form.PubKey = strings.ToLower(strings.TrimSpace(form.PubKey))
+	if !schemas.IsValidFollow(form.PubKey) {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid pubkey"))
+	}
+
+	// Publish contact list update event
+	err := publishListChange(c, nostr.KindContactList, "", schemas.FollowTag, form.PubKey, form.Unfollow)
+	if err != nil {
+		return serveListChangeError(c, err)
+	}
+
+	// Attempt redirect back to page that the user came from
+	return redirectBack(c, "/u/"+form.PubKey)
+}
+
+// contactListForPubkey queries the DB and returns a pubkey's latest contact list
+func contactListForPubkey(pubkey string) (*schemas.List, error) {
+	return listForPubkey(nostr.KindContactList, pubkey, "")
+}
+
+// upsertContactList replaces a user's contact list in the DB if the supplied list is newer
+func upsertContactList(contactList *schemas.List) error {
+	err := upsertList(contactList)
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the queryable rows for this list
+	_, err = db.Exec(`DELETE FROM follows WHERE pubkey = ?`, contactList.PubKey)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range contactList.Values(schemas.FollowTag) {
+		target = strings.ToLower(target)
+		if !schemas.IsValidFollow(target) {
+			continue
+		}
+		db.Exec(`INSERT INTO follows(pubkey, target) VALUES(?,?)`, contactList.PubKey, target)
+	}
+
+	invalidateTrustGraphs(contactList.PubKey)
+	return nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
+	"html/template"
 	"net/http"
+	"strings"
 
 	"github.com/rdbell/nvote/schemas"
 
@@ -17,31 +20,42 @@ func indexRoutes(e *echo.Echo) {
 }
 
 // indexHandler serves the index page
+// logged in users with channel subscriptions get a personal front page, everyone else gets /c/all
 func indexHandler(c echo.Context) error {
+	pubkey := c.Get("user").(*schemas.User).PubKey
+	if pubkey != "" {
+		if channelList, _ := channelListForPubkey(pubkey); len(channelList.Values(schemas.SubscriptionTag)) > 0 {
+			c.Set("subscribedBy", pubkey)
+		}
+	}
 	return viewPostsHandler(c)
 }
 
 // exploreHandler serves a list of top channels
 func exploreHandler(c echo.Context) error {
 	type channel struct {
-		Name  string
-		Count int
+		Name        string
+		Count       int
+		Description string
+		NSFW        bool
 	}
 
 	var page struct {
 		Channels []*channel
 	}
 
-	// Query channel top-level post counts
-	// TODO: consider keeping a separate 'channels' table with columns like 'channel', 'post_count', 'comment_count' and query against that instead
-	rows, err := db.Query(`SELECT DISTINCT(channel), COUNT(channel) AS cnt FROM posts WHERE parent = '' GROUP BY channel ORDER BY cnt DESC`)
+	// Query channel top-level post counts, along with descriptions for channels that have been defined
+	// TODO: consider keeping post and comment counts in the channels table and query against that instead
+	rows, err := db.Query(`SELECT posts.channel, COUNT(posts.channel) AS cnt, COALESCE(channels.description, ''), COALESCE(channels.nsfw, FALSE)
+		FROM posts LEFT JOIN channels ON channels.name = posts.channel
+		WHERE posts.parent = '' GROUP BY posts.channel ORDER BY cnt DESC`)
 	if err != nil {
 		return serveError(c, http.StatusInternalServerError, err)
 	}
 
 	for rows.Next() {
 		ch := &channel{}
-		err = rows.Scan(&ch.Name, &ch.Count)
+		err = rows.Scan(&ch.Name, &ch.Count, &ch.Description, &ch.NSFW)
 		if err != nil {
 			return serveError(c, http.StatusInternalServerError, err)
 		}
@@ -64,36 +78,46 @@ func activityHandler(c echo.Context) error {
 		Votes     []*schemas.Vote
 		Channel   string
 		UserVotes []*schemas.Vote
+		Karma     []*channelKarma
+		History   template.HTML
 	}
 
 	page.PubKey = c.Param("pubkey")
 	page.Channel = c.Param("channel")
 	page.Metadata = &schemas.Metadata{}
 
+	// Blocked users and channels only get the gateway's notice
+	if reason, blocked := blockReason(blockTypePubkey, page.PubKey); blocked {
+		return removedByGateway(c, reason)
+	}
+	if reason, blocked := blockReason(blockTypeChannel, schemas.SanitizeChannel(page.Channel)); blocked {
+		return removedByGateway(c, reason)
+	}
+
 	// Channel filter
 	// "all" is a special catch-all channel. no need to filter by "all"
 
 	// Recent posts
 	var err error
-	page.Posts, err = fetchPosts(&schemas.PostFilterset{
+	page.Posts, err = fetchPosts(userFilters(c, &schemas.PostFilterset{
 		Channel:       page.Channel,
 		PubKey:        page.PubKey,
 		PostType:      schemas.PostTypePosts,
 		OrderByColumn: "created_at",
 		Limit:         20,
-	})
+	}))
 	if err != nil {
 		return serveError(c, http.StatusInternalServerError, err)
 	}
 
 	// Recent comments
-	page.Comments, err = fetchPosts(&schemas.PostFilterset{
+	page.Comments, err = fetchPosts(userFilters(c, &schemas.PostFilterset{
 		Channel:       page.Channel,
 		PubKey:        page.PubKey,
 		PostType:      schemas.PostTypeComments,
 		OrderByColumn: "created_at",
 		Limit:         20,
-	})
+	}))
 	if err != nil {
 		return serveError(c, http.StatusInternalServerError, err)
 	}
@@ -124,6 +148,11 @@ func activityHandler(c echo.Context) error {
 	// Fill metadata for profile pages
 	if page.PubKey != "" {
 		page.Metadata, _ = metadataForPubkey(page.PubKey)
+		page.Karma, err = karmaForPubkey(page.PubKey)
+		if err != nil {
+			return serveError(c, http.StatusInternalServerError, err)
+		}
+		page.History = sparklineSVG(karmaHistory(page.PubKey, karmaHistoryDays))
 	}
 
 	pd := new(pageData).Init(c)
@@ -148,6 +177,14 @@ func serveError(c echo.Context, code int, err error) error {
 		Code    int
 		Message string
 	}
+	// Saturated proof-of-work mining is reported the same way by every handler that publishes
+	if errors.Is(err, errMiningBusy) {
+		code = http.StatusTooManyRequests
+	}
+	if code >= http.StatusInternalServerError {
+		recordError(c.Request().Method+" "+c.Request().URL.Path, err)
+	}
+
 	pd := new(pageData).Init(c)
 	page.Code = code
 	page.Message = err.Error()
@@ -155,3 +192,13 @@ func serveError(c echo.Context, code int, err error) error {
 	pd.Page = page
 	return c.Render(page.Code, "base:error", pd)
 }
+
+// redirectBack redirects to the page the user came from if it's on this site, or to a fallback path
+func redirectBack(c echo.Context, fallback string) error {
+	referer := c.Request().Header["Referer"]
+	if len(referer) != 0 && strings.Contains(referer[0], appConfig.SiteURL) {
+		return c.Redirect(http.StatusFound, referer[0])
+	}
+
+	return c.Redirect(http.StatusFound, fallback)
+}
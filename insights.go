@@ -0,0 +1,537 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// insightsRoutes sets up vote analysis routes
+func insightsRoutes(e *echo.Echo) {
+	e.GET("/insights", insightsHandler)
+	e.GET("/insights.json", insightsJSONHandler)
+}
+
+const (
+	// ringMinSharedVotes is how many identical votes two pubkeys need before they're compared
+	ringMinSharedVotes = 5
+	// ringMinOverlap is the share of two pubkeys' votes that must be identical to link them into a ring
+	ringMinOverlap = 0.5
+	// burstWindow is the time window that burst voting is measured over
+	burstWindow = 5 * 60
+	// burstMinVotes is how many votes a target must receive within burstWindow to count as a burst
+	burstMinVotes = 10
+	// newAccountAge is how long after an account's first event it counts as new
+	newAccountAge = 24 * 60 * 60
+	// newAccountMinVotes is how many votes from new accounts make a target or voter suspicious
+	newAccountMinVotes = 5
+	// newAccountMinShare is the share of a target's votes that must come from new accounts
+	newAccountMinShare = 0.5
+	// networkMinUpvotes is how many of one author's posts a voter must upvote to be checked for sock puppetry
+	networkMinUpvotes = 5
+	// networkMinShare is the share of a voter's upvotes that must go to one author
+	networkMinShare = 0.8
+	// insightsStartupDelay is how long to wait for the relays' backlog before the first analysis pass
+	insightsStartupDelay = time.Minute
+	// insightsListLimit caps the number of entries in each list of the report
+	insightsListLimit = 500
+	// insightsPageLimit caps the number of entries in each list on the insights page
+	insightsPageLimit = 50
+)
+
+// analyzedVotesStmt selects the votes that the analysis looks at
+// nvote upvotes every new post for its author, so votes on a user's own posts are left out
+const analyzedVotesStmt = `(SELECT votes.pubkey, votes.target, votes.direction, votes.created_at FROM votes
+	LEFT JOIN posts ON posts.id = votes.target WHERE posts.pubkey IS NULL OR posts.pubkey != votes.pubkey)`
+
+// insightsReport defines the results of a vote analysis pass
+type insightsReport struct {
+	GeneratedAt     uint32              `json:"generated_at"`
+	Votes           int                 `json:"votes"`
+	Rings           []*votingRing       `json:"voting_rings"`
+	Bursts          []*voteBurst        `json:"vote_bursts"`
+	NewAccountVotes []*newAccountVoting `json:"new_account_voting"`
+	Networks        []*selfVoteNetwork  `json:"self_vote_networks"`
+	Posts           []*suspicionScore   `json:"posts"`
+	Users           []*suspicionScore   `json:"users"`
+}
+
+// votingRing defines a group of pubkeys that repeatedly cast the same votes
+type votingRing struct {
+	Members     []string `json:"members"`
+	SharedVotes int      `json:"shared_votes"`
+}
+
+// voteBurst defines a target that received an unusual number of votes in a short window
+type voteBurst struct {
+	Target string `json:"target"`
+	Votes  int    `json:"votes"`
+	Start  uint32 `json:"start"`
+	End    uint32 `json:"end"`
+}
+
+// newAccountVoting defines a target that was mostly voted on by brand-new accounts
+type newAccountVoting struct {
+	Target          string `json:"target"`
+	NewAccountVotes int    `json:"new_account_votes"`
+	TotalVotes      int    `json:"total_votes"`
+}
+
+// selfVoteNetwork defines an author whose upvotes come from pubkeys that upvote little else
+type selfVoteNetwork struct {
+	Author  string   `json:"author"`
+	Voters  []string `json:"voters"`
+	Upvotes int      `json:"upvotes"`
+}
+
+// suspicionScore defines a post or user's combined suspicion, from 0 (nothing found) to 1
+type suspicionScore struct {
+	ID      string   `json:"id"`
+	Score   float64  `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+// add combines another signal into the score, treating signals as independent
+func (s *suspicionScore) add(score float64, reason string) {
+	s.Score = 1 - (1-s.Score)*(1-score)
+	s.Reasons = append(s.Reasons, reason)
+}
+
+// insightsCache holds the latest vote analysis
+var insightsCache = struct {
+	sync.RWMutex
+	report *insightsReport
+}{report: &insightsReport{}}
+
+// analyzeVotes periodically re-runs the vote analysis in the background
+func analyzeVotes() {
+	interval := time.Duration(appConfig.InsightsRefreshMinutes) * time.Minute
+	if interval <= 0 {
+		interval = 15 * time.Minute
+	}
+
+	// Give the relays a moment to send their backlog before the first pass
+	time.Sleep(insightsStartupDelay)
+
+	for {
+		report, err := buildInsightsReport()
+		if err == nil {
+			insightsCache.Lock()
+			insightsCache.report = report
+			insightsCache.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// latestInsights returns the latest vote analysis
+func latestInsights() *insightsReport {
+	insightsCache.RLock()
+	defer insightsCache.RUnlock()
+	return insightsCache.report
+}
+
+// analyzedVote defines the vote fields used by the analysis
+type analyzedVote struct {
+	PubKey    string
+	Target    string
+	Direction bool
+	CreatedAt uint32
+}
+
+// buildInsightsReport runs every detector over the votes table
+func buildInsightsReport() (*insightsReport, error) {
+	report := &insightsReport{
+		GeneratedAt:     uint32(time.Now().Unix()),
+		Bursts:          []*voteBurst{},
+		NewAccountVotes: []*newAccountVoting{},
+	}
+
+	// Load votes grouped by target, oldest first
+	rows, err := db.Query(`SELECT pubkey, target, direction, created_at FROM ` + analyzedVotesStmt + ` ORDER BY target, created_at`)
+	if err != nil {
+		return nil, err
+	}
+	byTarget := make(map[string][]*analyzedVote)
+	var targets []string
+	for rows.Next() {
+		vote := &analyzedVote{}
+		if rows.Scan(&vote.PubKey, &vote.Target, &vote.Direction, &vote.CreatedAt) != nil {
+			continue
+		}
+		if _, ok := byTarget[vote.Target]; !ok {
+			targets = append(targets, vote.Target)
+		}
+		byTarget[vote.Target] = append(byTarget[vote.Target], vote)
+		report.Votes++
+	}
+	rows.Close()
+
+	posts := make(map[string]*suspicionScore)
+	users := make(map[string]*suspicionScore)
+	postScore := func(id string) *suspicionScore {
+		if _, ok := posts[id]; !ok {
+			posts[id] = &suspicionScore{ID: id, Reasons: []string{}}
+		}
+		return posts[id]
+	}
+	userScore := func(pubkey string) *suspicionScore {
+		if _, ok := users[pubkey]; !ok {
+			users[pubkey] = &suspicionScore{ID: pubkey, Reasons: []string{}}
+		}
+		return users[pubkey]
+	}
+
+	// Voting rings
+	report.Rings, err = detectVotingRings()
+	if err != nil {
+		return nil, err
+	}
+	ringMembers := make(map[string]bool)
+	for _, ring := range report.Rings {
+		score := 0.3 + 0.1*float64(len(ring.Members)-2)
+		if score > 0.8 {
+			score = 0.8
+		}
+		for _, member := range ring.Members {
+			ringMembers[member] = true
+			userScore(member).add(score, "member of a voting ring")
+		}
+	}
+
+	// Self-vote networks
+	report.Networks, err = detectSelfVoteNetworks()
+	if err != nil {
+		return nil, err
+	}
+	puppets := make(map[string]bool)
+	for _, network := range report.Networks {
+		score := 0.2 * float64(len(network.Voters))
+		if score > 0.8 {
+			score = 0.8
+		}
+		userScore(network.Author).add(score, "upvoted by a self-vote network")
+		for _, voter := range network.Voters {
+			puppets[voter] = true
+			userScore(voter).add(0.6, "mostly upvotes one author")
+		}
+	}
+
+	// New accounts voting en masse
+	firstSeen := make(map[string]uint32)
+	rows, err = db.Query(`SELECT pubkey, first_seen FROM users WHERE first_seen IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var pubkey string
+		var seen uint32
+		if rows.Scan(&pubkey, &seen) == nil {
+			firstSeen[pubkey] = seen
+		}
+	}
+	rows.Close()
+
+	newAccountVoters := make(map[string]int)
+	for _, target := range targets {
+		votes := byTarget[target]
+
+		newVotes, ringVotes, puppetVotes, upvotes := 0, 0, 0, 0
+		for _, vote := range votes {
+			if seen, ok := firstSeen[vote.PubKey]; ok && isNewAccountVote(vote.CreatedAt, seen) {
+				newVotes++
+				newAccountVoters[vote.PubKey]++
+			}
+			if ringMembers[vote.PubKey] {
+				ringVotes++
+			}
+			if vote.Direction {
+				upvotes++
+				if puppets[vote.PubKey] {
+					puppetVotes++
+				}
+			}
+		}
+
+		share := float64(newVotes) / float64(len(votes))
+		if newVotes >= newAccountMinVotes && share >= newAccountMinShare {
+			report.NewAccountVotes = append(report.NewAccountVotes, &newAccountVoting{Target: target, NewAccountVotes: newVotes, TotalVotes: len(votes)})
+			postScore(target).add(0.8*share, "mostly voted on by new accounts")
+		}
+		if ringVotes >= 2 {
+			postScore(target).add(0.8*float64(ringVotes)/float64(len(votes)), "voted on by a voting ring")
+		}
+		if puppetVotes >= 2 {
+			postScore(target).add(0.8*float64(puppetVotes)/float64(upvotes), "upvoted by a self-vote network")
+		}
+
+		// Burst voting. Find the busiest window for this target
+		if burst := detectBurst(votes); burst != nil {
+			report.Bursts = append(report.Bursts, burst)
+			postScore(target).add(0.5, "burst of votes")
+		}
+	}
+	for pubkey, count := range newAccountVoters {
+		if count >= newAccountMinVotes {
+			userScore(pubkey).add(0.4, "new account voting en masse")
+		}
+	}
+
+	// Sort and cap the lists
+	sort.Slice(report.Bursts, func(i, j int) bool { return report.Bursts[i].Votes > report.Bursts[j].Votes })
+	sort.Slice(report.NewAccountVotes, func(i, j int) bool {
+		return report.NewAccountVotes[i].NewAccountVotes > report.NewAccountVotes[j].NewAccountVotes
+	})
+	report.Posts = sortedScores(posts)
+	report.Users = sortedScores(users)
+
+	if len(report.Bursts) > insightsListLimit {
+		report.Bursts = report.Bursts[:insightsListLimit]
+	}
+	if len(report.NewAccountVotes) > insightsListLimit {
+		report.NewAccountVotes = report.NewAccountVotes[:insightsListLimit]
+	}
+	if len(report.Rings) > insightsListLimit {
+		report.Rings = report.Rings[:insightsListLimit]
+	}
+	if len(report.Networks) > insightsListLimit {
+		report.Networks = report.Networks[:insightsListLimit]
+	}
+
+	return report, nil
+}
+
+// detectBurst returns the busiest burstWindow of a target's votes, if it's busy enough to count as a burst
+// votes must be sorted oldest first
+func detectBurst(votes []*analyzedVote) *voteBurst {
+	var best *voteBurst
+	start := 0
+	for end := range votes {
+		for votes[end].CreatedAt-votes[start].CreatedAt > burstWindow {
+			start++
+		}
+		count := end - start + 1
+		if count >= burstMinVotes && (best == nil || count > best.Votes) {
+			best = &voteBurst{Target: votes[end].Target, Votes: count, Start: votes[start].CreatedAt, End: votes[end].CreatedAt}
+		}
+	}
+	return best
+}
+
+// detectVotingRings links pubkeys that cast mostly the same votes, and groups linked pubkeys into rings
+func detectVotingRings() ([]*votingRing, error) {
+	// Total votes per pubkey, to measure overlap
+	totals := make(map[string]int)
+	rows, err := db.Query(`SELECT pubkey, COUNT(*) FROM ` + analyzedVotesStmt + ` GROUP BY pubkey`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var pubkey string
+		var count int
+		if rows.Scan(&pubkey, &count) == nil {
+			totals[pubkey] = count
+		}
+	}
+	rows.Close()
+
+	// Pairs of pubkeys that cast the same vote on the same target
+	rows, err = db.Query(`
+		SELECT a.pubkey, b.pubkey, COUNT(*) FROM `+analyzedVotesStmt+` a
+		JOIN `+analyzedVotesStmt+` b ON a.target = b.target AND a.direction = b.direction AND a.pubkey < b.pubkey
+		GROUP BY a.pubkey, b.pubkey HAVING COUNT(*) >= ?`, ringMinSharedVotes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Union linked pubkeys into rings
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(pubkey string) string {
+		if parent[pubkey] == "" || parent[pubkey] == pubkey {
+			parent[pubkey] = pubkey
+			return pubkey
+		}
+		root := find(parent[pubkey])
+		parent[pubkey] = root
+		return root
+	}
+	shared := make(map[[2]string]int)
+	for rows.Next() {
+		var a, b string
+		var count int
+		if rows.Scan(&a, &b, &count) != nil {
+			continue
+		}
+		overlap := float64(count) / float64(totals[a]+totals[b]-count)
+		if overlap < ringMinOverlap {
+			continue
+		}
+		rootA, rootB := find(a), find(b)
+		if rootA != rootB {
+			parent[rootA] = rootB
+		}
+		shared[[2]string{a, b}] = count
+	}
+	rows.Close()
+
+	groups := make(map[string]*votingRing)
+	for pubkey := range parent {
+		root := find(pubkey)
+		if _, ok := groups[root]; !ok {
+			groups[root] = &votingRing{}
+		}
+		groups[root].Members = append(groups[root].Members, pubkey)
+	}
+	for pair, count := range shared {
+		groups[find(pair[0])].SharedVotes += count
+	}
+
+	rings := []*votingRing{}
+	for _, ring := range groups {
+		sort.Strings(ring.Members)
+		rings = append(rings, ring)
+	}
+	sort.Slice(rings, func(i, j int) bool { return len(rings[i].Members) > len(rings[j].Members) })
+
+	return rings, nil
+}
+
+// detectSelfVoteNetworks finds authors whose upvotes come from pubkeys that upvote little else
+func detectSelfVoteNetworks() ([]*selfVoteNetwork, error) {
+	// Total upvotes per pubkey
+	totals := make(map[string]int)
+	rows, err := db.Query(`SELECT pubkey, COUNT(*) FROM ` + analyzedVotesStmt + ` WHERE direction GROUP BY pubkey`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var pubkey string
+		var count int
+		if rows.Scan(&pubkey, &count) == nil {
+			totals[pubkey] = count
+		}
+	}
+	rows.Close()
+
+	// Upvotes from each voter to each other author
+	rows, err = db.Query(`
+		SELECT votes.pubkey, posts.pubkey, COUNT(*) FROM votes
+		JOIN posts ON posts.id = votes.target
+		WHERE votes.direction AND votes.pubkey != posts.pubkey
+		GROUP BY votes.pubkey, posts.pubkey HAVING COUNT(*) >= ?`, networkMinUpvotes)
+	if err != nil {
+		return nil, err
+	}
+
+	networks := make(map[string]*selfVoteNetwork)
+	for rows.Next() {
+		var voter, author string
+		var count int
+		if rows.Scan(&voter, &author, &count) != nil {
+			continue
+		}
+		if float64(count)/float64(totals[voter]) < networkMinShare {
+			continue
+		}
+		if _, ok := networks[author]; !ok {
+			networks[author] = &selfVoteNetwork{Author: author}
+		}
+		networks[author].Voters = append(networks[author].Voters, voter)
+		networks[author].Upvotes += count
+	}
+	rows.Close()
+
+	result := []*selfVoteNetwork{}
+	for _, network := range networks {
+		sort.Strings(network.Voters)
+		result = append(result, network)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Upvotes > result[j].Upvotes })
+
+	return result, nil
+}
+
+// sortedScores returns suspicion scores sorted from most to least suspicious
+func sortedScores(scores map[string]*suspicionScore) []*suspicionScore {
+	result := []*suspicionScore{}
+	for _, score := range scores {
+		result = append(result, score)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score == result[j].Score {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Score > result[j].Score
+	})
+	if len(result) > insightsListLimit {
+		result = result[:insightsListLimit]
+	}
+	return result
+}
+
+// insightsHandler serves the public vote analysis page
+func insightsHandler(c echo.Context) error {
+	// Only show the top of each list. The JSON endpoint has the rest
+	page := *latestInsights()
+	if len(page.Rings) > insightsPageLimit {
+		page.Rings = page.Rings[:insightsPageLimit]
+	}
+	if len(page.Bursts) > insightsPageLimit {
+		page.Bursts = page.Bursts[:insightsPageLimit]
+	}
+	if len(page.NewAccountVotes) > insightsPageLimit {
+		page.NewAccountVotes = page.NewAccountVotes[:insightsPageLimit]
+	}
+	if len(page.Networks) > insightsPageLimit {
+		page.Networks = page.Networks[:insightsPageLimit]
+	}
+	if len(page.Posts) > insightsPageLimit {
+		page.Posts = page.Posts[:insightsPageLimit]
+	}
+	if len(page.Users) > insightsPageLimit {
+		page.Users = page.Users[:insightsPageLimit]
+	}
+
+	pd := new(pageData).Init(c)
+	pd.Title = "Insights"
+	pd.Page = page
+	return c.Render(http.StatusOK, "base:insights", pd)
+}
+
+// insightsJSONHandler serves the vote analysis as JSON
+// ?post=<id> or ?pubkey=<pubkey> returns a single suspicion score
+func insightsJSONHandler(c echo.Context) error {
+	report := latestInsights()
+
+	// Anyone can digest this data
+	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
+
+	if id := c.QueryParam("post"); id != "" {
+		return c.JSON(http.StatusOK, findScore(report.Posts, id))
+	}
+	if pubkey := c.QueryParam("pubkey"); pubkey != "" {
+		return c.JSON(http.StatusOK, findScore(report.Users, pubkey))
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// findScore returns the suspicion score for an ID, or a zero score if nothing was found
+func findScore(scores []*suspicionScore, id string) *suspicionScore {
+	for _, score := range scores {
+		if score.ID == id {
+			return score
+		}
+	}
+	return &suspicionScore{ID: id, Reasons: []string{}}
+}
+
+// isNewAccountVote returns true if a vote was cast before its voter's account stopped counting as new
+// votes dated before the account was first seen count as new too
+func isNewAccountVote(createdAt uint32, firstSeen uint32) bool {
+	return createdAt < firstSeen || createdAt-firstSeen < newAccountAge
+}
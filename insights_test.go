@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestIsNewAccountVote(t *testing.T) {
+	const seen = 1700000000
+	tests := []struct {
+		createdAt uint32
+		want      bool
+	}{
+		{seen, true},
+		{seen + newAccountAge - 1, true},
+		{seen + newAccountAge, false},
+		{seen + 30*86400, false},
+		{seen - 1, true}, // backdated votes don't wrap around to look old
+		{0, true},
+	}
+
+	for _, test := range tests {
+		if got := isNewAccountVote(test.createdAt, seen); got != test.want {
+			t.Errorf("isNewAccountVote(%d, %d) = %v, want %v", test.createdAt, seen, got, test.want)
+		}
+	}
+}
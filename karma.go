@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// karmaHistoryDays is the number of days shown in a user's karma history
+const karmaHistoryDays = 30
+
+// channelKarma defines a user's karma within one channel
+type channelKarma struct {
+	Channel      string // channel name
+	PostKarma    int    // score earned by the user's posts in the channel
+	CommentKarma int    // score earned by the user's comments in the channel
+}
+
+// Total returns the channel's post and comment karma combined
+func (k *channelKarma) Total() int {
+	return k.PostKarma + k.CommentKarma
+}
+
+// addKarma adds a vote's score change to a user's karma in a channel, and to the history for the day the vote was cast
+func addKarma(pubkey string, channel string, comment bool, delta int, createdAt uint32) error {
+	postDelta, commentDelta := delta, 0
+	if comment {
+		postDelta, commentDelta = 0, delta
+	}
+
+	_, err := db.Exec(`INSERT INTO karma(pubkey, channel, post_karma, comment_karma) VALUES(?,?,?,?)
+		ON CONFLICT (pubkey, channel) DO UPDATE SET post_karma=post_karma+excluded.post_karma, comment_karma=comment_karma+excluded.comment_karma`,
+		pubkey, channel, postDelta, commentDelta)
+	if err != nil {
+		return err
+	}
+
+	// Votes arrive from the relays out of order, so record daily changes rather than running totals
+	_, err = db.Exec(`INSERT INTO karma_history(pubkey, channel, day, post_karma, comment_karma) VALUES(?,?,?,?,?)
+		ON CONFLICT (pubkey, channel, day) DO UPDATE SET post_karma=post_karma+excluded.post_karma, comment_karma=comment_karma+excluded.comment_karma`,
+		pubkey, channel, createdAt/86400, postDelta, commentDelta)
+	return err
+}
+
+// karmaForPubkey returns a user's karma in each channel, highest first
+func karmaForPubkey(pubkey string) ([]*channelKarma, error) {
+	rows, err := db.Query(`SELECT channel, post_karma, comment_karma FROM karma WHERE pubkey = ? ORDER BY post_karma + comment_karma DESC, channel ASC`, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var karma []*channelKarma
+	for rows.Next() {
+		k := &channelKarma{}
+		err = rows.Scan(&k.Channel, &k.PostKarma, &k.CommentKarma)
+		if err != nil {
+			return nil, err
+		}
+		karma = append(karma, k)
+	}
+
+	return karma, rows.Err()
+}
+
+// karmaTotal returns a user's karma summed across every channel
+func karmaTotal(pubkey string) int {
+	var total int
+	db.QueryRow(`SELECT COALESCE(SUM(post_karma + comment_karma), 0) FROM karma WHERE pubkey = ?`, pubkey).Scan(&total)
+	return total
+}
+
+// karmaHistory returns a user's total karma at the end of each of the last few days, oldest first
+func karmaHistory(pubkey string, days int) []int {
+	today := time.Now().Unix() / 86400
+	first := today - int64(days) + 1
+
+	// Everything before the first day is the starting point
+	var total int
+	db.QueryRow(`SELECT COALESCE(SUM(post_karma + comment_karma), 0) FROM karma_history WHERE pubkey = ? AND day < ?`, pubkey, first).Scan(&total)
+
+	changes := make([]int, days)
+	rows, err := db.Query(`SELECT day, SUM(post_karma + comment_karma) FROM karma_history WHERE pubkey = ? AND day >= ? GROUP BY day`, pubkey, first)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var day int64
+			var change int
+			if rows.Scan(&day, &change) != nil {
+				continue
+			}
+
+			// Votes dated in the future count towards today
+			index := int(day - first)
+			if index >= days {
+				index = days - 1
+			}
+			changes[index] += change
+		}
+	}
+
+	history := make([]int, days)
+	for i, change := range changes {
+		total += change
+		history[i] = total
+	}
+
+	return history
+}
+
+// channelKarmaStmt returns a SQL condition hiding posts whose authors have less than a minimum karma in the post's channel
+func channelKarmaStmt(min int) string {
+	return fmt.Sprintf(" AND COALESCE((SELECT karma.post_karma + karma.comment_karma FROM karma WHERE karma.pubkey = posts.pubkey AND karma.channel = posts.channel), 0) >= %d", min)
+}
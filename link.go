@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// linkRoutes sets up link routes
+func linkRoutes(e *echo.Echo) {
+	e.GET("/domain/:host", viewPostsHandler)
+}
+
+// trackingParams lists query parameters that only track where a link was shared, and don't change the page it links to
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"msclkid": true,
+	"yclid":   true,
+	"igshid":  true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"ref_src": true,
+	"_hsenc":  true,
+	"_hsmi":   true,
+}
+
+// canonicalURL returns the canonical form of a link post's URL, or an empty string if the body isn't a single link
+// the scheme, "www." prefix, default ports, tracking parameters, fragment and trailing slash are dropped,
+// so the same page submitted through different links is recognised as a duplicate
+func canonicalURL(body string) string {
+	body = strings.TrimSpace(body)
+	if strings.ContainsAny(body, " \n") {
+		return ""
+	}
+	// stringToURL keeps the fragment in the path, so drop it first
+	if i := strings.Index(body, "#"); i >= 0 {
+		body = body[:i]
+	}
+	u, err := stringToURL(body)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+
+	host := sanitizeDomain(u.Hostname())
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	query := u.Query()
+	for param := range query {
+		if trackingParams[strings.ToLower(param)] || strings.HasPrefix(strings.ToLower(param), "utm_") {
+			query.Del(param)
+		}
+	}
+
+	canonical := host + strings.TrimRight(u.EscapedPath(), "/")
+	if len(query) > 0 {
+		canonical += "?" + query.Encode()
+	}
+	return canonical
+}
+
+// linkHost returns the host a link post links to, without the "www." prefix, or an empty string if the body isn't a single link
+func linkHost(body string) string {
+	canonical := canonicalURL(body)
+	if canonical == "" {
+		return ""
+	}
+
+	u, err := url.Parse("https://" + canonical)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// sanitizeDomain normalizes a domain for comparison, and returns an empty string if it isn't a valid domain
+func sanitizeDomain(domain string) string {
+	domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "www.")
+	if strings.ContainsAny(domain, " /?#@:%") {
+		return ""
+	}
+	return strings.TrimSuffix(domain, ".")
+}
@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"https://example.com/page", "example.com/page"},
+		{"  https://example.com/page\n", "example.com/page"},
+		{"https://www.Example.com/a/b/", "example.com/a/b"},
+		{"http://example.com:80/", "example.com"},
+		{"https://example.com:443/x", "example.com/x"},
+		{"https://example.com:8443/x", "example.com:8443/x"},
+		{"https://example.com/page#comments", "example.com/page"},
+		{"https://example.com/?utm_source=feed&UTM_MEDIUM=rss&fbclid=abc", "example.com"},
+		{"https://example.com/watch?v=123&utm_campaign=x", "example.com/watch?v=123"},
+		{"https://example.com/?b=2&a=1", "example.com?a=1&b=2"},
+		{"check out https://example.com", ""},
+		{"https://example.com\nhttps://example.org", ""},
+		{"ftp://example.com/file", ""},
+		{"example.com/page", ""},
+		{"short", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := canonicalURL(test.body); got != test.want {
+			t.Errorf("canonicalURL(%q) = %q, want %q", test.body, got, test.want)
+		}
+	}
+}
+
+func TestLinkHost(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"https://example.com/page", "example.com"},
+		{"https://www.news.example.co.uk/story?id=1", "news.example.co.uk"},
+		{"https://example.com:8443/x", "example.com"},
+		{"HTTPS://WWW.EXAMPLE.COM", "example.com"},
+		{"hello world", ""},
+		{"ftp://example.com/file", ""},
+	}
+
+	for _, test := range tests {
+		if got := linkHost(test.body); got != test.want {
+			t.Errorf("linkHost(%q) = %q, want %q", test.body, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.com", "example.com"},
+		{" WWW.Example.COM. ", "example.com"},
+		{"sub.example.com", "sub.example.com"},
+		{"example.com/path", ""},
+		{"example.com?q=1", ""},
+		{"user@example.com", ""},
+		{"example.com:8080", ""},
+		{"exa mple.com", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := sanitizeDomain(test.domain); got != test.want {
+			t.Errorf("sanitizeDomain(%q) = %q, want %q", test.domain, got, test.want)
+		}
+	}
+}
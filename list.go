@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// listForPubkey queries the DB and returns a pubkey's latest list of a kind
+// an empty list is returned along with the error if the pubkey hasn't published one
+func listForPubkey(kind int, pubkey string, d string) (*schemas.List, error) {
+	list := &schemas.List{Kind: kind, PubKey: pubkey, D: d}
+
+	var tags string
+	err := db.QueryRow(`SELECT created_at, tags, content FROM lists WHERE kind = ? AND pubkey = ? AND d = ?`, kind, pubkey, d).Scan(&list.CreatedAt, &tags, &list.Content)
+	if err != nil {
+		return list, err
+	}
+
+	err = json.Unmarshal([]byte(tags), &list.Tags)
+	return list, err
+}
+
+// upsertList replaces a pubkey's list in the DB if the supplied list is newer
+// callers rebuild their own queryable rows from the list afterwards
+func upsertList(list *schemas.List) error {
+	var createdAt uint32
+	err := db.QueryRow(`SELECT created_at FROM lists WHERE kind = ? AND pubkey = ? AND d = ?`, list.Kind, list.PubKey, list.D).Scan(&createdAt)
+	if err == nil && createdAt >= list.CreatedAt {
+		return errors.New("list is outdated")
+	}
+
+	tags, err := json.Marshal(list.Tags)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO lists(kind, pubkey, d, created_at, tags, content) VALUES(?,?,?,?,?,?)
+		ON CONFLICT (kind, pubkey, d) DO UPDATE SET created_at=excluded.created_at, tags=excluded.tags, content=excluded.content`,
+		list.Kind, list.PubKey, list.D, list.CreatedAt, string(tags), list.Content)
+	return err
+}
+
+// errNoStoredList is returned when changing a list that hasn't been ingested. publishing would replace the user's published list
+var errNoStoredList = errors.New("no published list found")
+
+// publishListChange adds or removes a value on the logged in user's list and republishes it
+// it starts from the latest published list so items set by other clients are kept.
+// if no list has been ingested, the user may have one that this gateway hasn't seen yet, so a new list is only started once the form confirms it
+func publishListChange(c echo.Context, kind int, d string, tag string, value string, remove bool) error {
+	list, err := listForPubkey(kind, c.Get("user").(*schemas.User).PubKey, d)
+	if errors.Is(err, sql.ErrNoRows) {
+		if c.FormValue("new_list") != "true" {
+			return errNoStoredList
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if remove {
+		list.Remove(tag, value)
+	} else {
+		list.Add(tag, value)
+	}
+
+	_, err = publishEvent(c, []byte(list.Content), kind, list.Tags)
+	return err
+}
+
+// serveListChangeError serves a page asking the user to confirm starting a new list, or an error page for other errors
+func serveListChangeError(c echo.Context, err error) error {
+	if !errors.Is(err, errNoStoredList) {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	// Resubmit the same form, confirming the new list
+	params, _ := c.FormParams()
+	fields := make(map[string]string)
+	for key, values := range params {
+		if key == "csrf" || key == "new_list" || len(values) == 0 {
+			continue
+		}
+		fields[key] = values[0]
+	}
+
+	var page struct {
+		Action string
+		Fields map[string]string
+	}
+	page.Action = c.Request().URL.Path
+	page.Fields = fields
+
+	pd := new(pageData).Init(c)
+	pd.Title = "Start a new list"
+	pd.Page = page
+	return c.Render(http.StatusConflict, "base:list_confirm", pd)
+}
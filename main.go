@@ -36,6 +36,8 @@ func init() {
 		break
 	}
 	schemas.InitConfig(appConfig)
+	initVerifier()
+	initContentFilters()
 
 	// Load templates
 	box := packr.New("WebTemplatesBox", "./views")
@@ -47,11 +49,35 @@ func init() {
 	setupUsersTable()
 	setupVotesTable()
 	setupMetadataTable()
-
-	go fetchEvents()
+	setupNIP05NamesTable()
+	setupListsTable()
+	setupMutesTables()
+	setupFollowsTables()
+	setupSubscriptionsTables()
+	setupTrustTable()
+	setupPostFlagsTable()
+	setupKarmaTables()
+	setupChannelsTable()
+	setupPostTagsTable()
+	setupModerationTables()
+	setupReportsTable()
+	setupBlocklistTables()
+	loadBlocklist()
+	loadFirstSeen()
+	loadChannelOwners()
+	loadNIP05Names()
 }
 
 func main() {
+	// Start background workers here rather than in init, so tests get the DB without connecting to relays
+	go fetchEvents()
+	go checkNIP05Identifiers()
+	go refreshTrustGraphs()
+	go analyzeVotes()
+	if appConfig.VoteWeighting {
+		go refreshVoteWeights()
+	}
+
 	// Echo instance
 	e := echo.New()
 
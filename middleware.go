@@ -2,8 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strings"
@@ -70,6 +70,7 @@ func setupContext(next echo.HandlerFunc) echo.HandlerFunc {
 
 		// Decode user
 		user := &schemas.User{}
+		user.SetDefaultThresholds()
 		err = json.Unmarshal([]byte(cookie.Value), &user)
 
 		// Clear user cookie if unmarshal fails
@@ -114,76 +115,51 @@ func isLoggedIn(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-// checkVerification returns true if a pubkey is verified with the relay
-func checkVerification(pubkey string) (bool, error) {
-	response, err := http.Get(appConfig.CheckVerifiedBaseURL + "/" + pubkey)
-	if err != nil {
-		return false, err
-	}
-
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return false, err
-	}
-
-	if strings.Contains(string(contents), "pubkey registered at timestamp") {
-		// User is registered, continue
-		return true, nil
-	}
-
-	return false, nil
-}
-
-// isVerified middleware ensures a user is registered with the relay
+// isVerified middleware ensures a user is verified with the configured verification backend
 func isVerified(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		// Skip this middleware if no registration-check URL is defined
-		if appConfig.CheckVerifiedBaseURL == "" {
-			return next(c)
-		}
-
 		user := c.Get("user").(*schemas.User)
 		verified, err := checkVerification(user.PubKey)
 		if err != nil {
 			return serveError(c, http.StatusInternalServerError, err)
 		}
 
-		if verified {
+		// Unverified users may still post if the gateway mines proof-of-work for them
+		if verified || powAllowsUnverified() {
 			return next(c)
 		}
 
-		// User is not registered, go to verify page
+		// User is not verified, go to verify page
 		return c.Redirect(http.StatusFound, "/verify")
 	}
 }
 
-// isNotVerified middleware ensures a user is registered with the relay
+// isNotVerified middleware ensures a user is not yet verified with the configured verification backend
 func isNotVerified(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		// Skip this middleware if no registration-check URL is defined
-		if appConfig.CheckVerifiedBaseURL == "" {
-			return c.Redirect(http.StatusFound, "/")
-		}
-
 		user := c.Get("user").(*schemas.User)
-		response, err := http.Get(appConfig.CheckVerifiedBaseURL + "/" + user.PubKey)
+		verified, err := checkVerification(user.PubKey)
 		if err != nil {
 			return serveError(c, http.StatusInternalServerError, err)
 		}
 
-		defer response.Body.Close()
-		contents, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return serveError(c, http.StatusInternalServerError, err)
+		if verified {
+			// User is already verified, go back to index
+			return c.Redirect(http.StatusFound, "/")
 		}
 
-		if strings.Contains(string(contents), "pubkey registered at timestamp") {
-			// User is already registered, go back to index
-			return c.Redirect(http.StatusFound, "/")
+		// User not verified, continue
+		return next(c)
+	}
+}
+
+// isOperatorUser middleware ensures a user is one of the gateway's operators
+func isOperatorUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !isOperator(c.Get("user").(*schemas.User).PubKey) {
+			return serveError(c, http.StatusUnauthorized, errors.New("only the gateway's operators can view this page"))
 		}
 
-		// User not registered, continue
 		return next(c)
 	}
 }
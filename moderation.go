@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// moderationRoutes sets up channel moderation routes
+func moderationRoutes(e *echo.Echo) {
+	e.POST("/c/:channel/moderators", isLoggedIn(isVerified(moderatorsSubmitHandler)))
+	e.POST("/p/:id/moderate", isLoggedIn(isVerified(moderateSubmitHandler)))
+	e.POST("/u/:pubkey/moderate", isLoggedIn(isVerified(moderateSubmitHandler)))
+}
+
+// moderatorForm defines a request to add or remove a channel moderator
+type moderatorForm struct {
+	PubKey string `form:"pubkey"` // moderator's pubkey
+	Remove bool   `form:"remove"` // remove the pubkey from the moderator list instead of adding it
+}
+
+// removedStmt is a SQL condition excluding posts removed by channel moderators
+const removedStmt = " AND posts.id NOT IN (SELECT target FROM removed_posts)"
+
+// lockedStmt is a SQL condition excluding replies posted after their thread was locked by a channel moderator or its author
+// backdated replies count from when they arrived (see postedAt)
+const lockedStmt = " AND NOT EXISTS (SELECT 1 FROM closed_threads WHERE closed_threads.target = posts.root AND posts.posted_at > closed_threads.created_at)"
+
+// pinnedStmt is a SQL condition including only posts pinned by channel moderators
+const pinnedStmt = " AND posts.id IN (SELECT target FROM pinned_posts)"
+
+// announcedStmt is a SQL condition including only posts pinned to the front page by the gateway operators
+const announcedStmt = " AND posts.id IN (SELECT target FROM announced_posts)"
+
+// maxPinDays is the longest expiry that can be set on a pin
+const maxPinDays = 365
+
+// moderatorsSubmitHandler adds or removes a moderator on a channel's moderator list and republishes it
+func moderatorsSubmitHandler(c echo.Context) error {
+	form := &moderatorForm{}
+	if err := c.Bind(form); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	form.PubKey = strings.ToLower(strings.TrimSpace(form.PubKey))
+	if !schemas.IsValidFollow(form.PubKey) {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid pubkey"))
+	}
+
+	// Only the channel's creator appoints moderators
+	name := schemas.SanitizeChannel(c.Param("channel"))
+	pubkey := c.Get("user").(*schemas.User).PubKey
+	channel, err := channelForName(name)
+	if err != nil || channel.Creator != pubkey {
+		return serveError(c, http.StatusUnauthorized, errors.New("only the channel's creator can appoint moderators"))
+	}
+
+	// Publish moderator list update event
+	err = publishListChange(c, schemas.KindModeratorList, name, schemas.ModeratorTag, form.PubKey, form.Remove)
+	if err != nil {
+		return serveListChangeError(c, err)
+	}
+
+	return c.Redirect(http.StatusFound, "/c/"+name+"/edit")
+}
+
+// moderateSubmitHandler publishes a moderator's action on a post, or an operator's action on a post or user
+func moderateSubmitHandler(c echo.Context) error {
+	action := &schemas.ModerationAction{}
+	if err := c.Bind(action); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+	action.Target = c.Param("id")
+	if action.TargetsUser() {
+		action.Target = c.Param("pubkey")
+	}
+	action.Reason = strings.TrimSpace(action.Reason)
+
+	// Pins can be set to expire after a number of days
+	if days := c.FormValue("expires_in"); days != "" && action.Action == schemas.ModerationPin {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 || n > maxPinDays {
+			return serveError(c, http.StatusInternalServerError, errors.New("invalid pin expiry"))
+		}
+		if n > 0 {
+			action.Expires = uint32(time.Now().AddDate(0, 0, n).Unix())
+		}
+	}
+
+	if !action.IsValid() {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid moderation action"))
+	}
+
+	pubkey := c.Get("user").(*schemas.User).PubKey
+	if action.IsGatewayAction() && !isOperator(pubkey) {
+		return serveError(c, http.StatusUnauthorized, errors.New("only the gateway's operators can do that"))
+	}
+	if !action.IsGatewayAction() && !canModerate(action.Target, pubkey) && !canLockThread(action, pubkey) {
+		return serveError(c, http.StatusUnauthorized, errors.New("only the channel's moderators can do that"))
+	}
+
+	// Serialize content
+	content, err := json.Marshal(action)
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	// Publish moderation action event
+	_, err = publishEvent(c, content, schemas.KindModerationAction, action.Tags())
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	// Attempt redirect back to page that the user came from
+	if action.TargetsUser() {
+		return redirectBack(c, "/u/"+action.Target)
+	}
+	return redirectBack(c, "/p/"+action.Target)
+}
+
+// canModerate returns true if a pubkey moderates the channel a post belongs to
+func canModerate(id string, pubkey string) bool {
+	if pubkey == "" {
+		return false
+	}
+
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM channel_moderators JOIN posts ON posts.channel = channel_moderators.channel WHERE posts.id = ? AND channel_moderators.pubkey = ?`, id, pubkey).Scan(&count)
+	return count > 0
+}
+
+// canLockThread returns true if a moderation action locks or unlocks a thread started by the pubkey
+func canLockThread(action *schemas.ModerationAction, pubkey string) bool {
+	if action.Action != schemas.ModerationLock && action.Action != schemas.ModerationUnlock {
+		return false
+	}
+
+	post, err := getPost(action.Target)
+	return err == nil && post.PubKey == pubkey && post.IsValidPost() && post.Parent == ""
+}
+
+// moderatorsForChannel returns a channel's moderators, not including its creator
+func moderatorsForChannel(name string) []string {
+	var moderators []string
+
+	rows, err := db.Query(`SELECT channel_moderators.pubkey FROM channel_moderators JOIN channels ON channels.name = channel_moderators.channel
+		WHERE channel_moderators.channel = ? AND channel_moderators.pubkey != channels.creator`, name)
+	if err != nil {
+		return moderators
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pubkey string
+		if rows.Scan(&pubkey) == nil {
+			moderators = append(moderators, pubkey)
+		}
+	}
+
+	return moderators
+}
+
+// moderatePosts fills the moderation state of a page's posts, including whether their threads are locked or archived,
+// and whether the filterset's viewer moderates each post's channel
+func moderatePosts(posts []*schemas.Post, filters *schemas.PostFilterset) {
+	byID, in, args := postsByID(posts)
+
+	rows, err := db.Query(`SELECT target, COALESCE(reason, '') FROM removed_posts WHERE target IN (`+in+`)`, args...)
+	if err == nil {
+		for rows.Next() {
+			var id, reason string
+			if rows.Scan(&id, &reason) != nil {
+				continue
+			}
+			for _, post := range byID[id] {
+				post.Moderation.Removed = true
+				post.Moderation.Reason = reason
+			}
+		}
+		rows.Close()
+	}
+
+	// Locks and archiving apply to the whole thread
+	rows, err = db.Query(`SELECT posts.id, COALESCE(roots.created_at, 0),
+		EXISTS(SELECT 1 FROM locked_threads WHERE target = COALESCE(roots.id, posts.id)),
+		EXISTS(SELECT 1 FROM author_locked_threads WHERE target = COALESCE(roots.id, posts.id)),
+		EXISTS(SELECT 1 FROM pinned_posts WHERE target = posts.id),
+		EXISTS(SELECT 1 FROM announced_posts WHERE target = posts.id)
+		FROM posts LEFT JOIN posts AS roots ON roots.id = posts.root WHERE posts.id IN (`+in+`)`, args...)
+	if err == nil {
+		for rows.Next() {
+			var id string
+			var rootCreatedAt uint32
+			var moderation schemas.PostModeration
+			if rows.Scan(&id, &rootCreatedAt, &moderation.Locked, &moderation.LockedByAuthor, &moderation.Pinned, &moderation.Announced) != nil {
+				continue
+			}
+			moderation.Archived = rootCreatedAt != 0 && isArchived(rootCreatedAt)
+			for _, post := range byID[id] {
+				moderation.Removed = post.Moderation.Removed
+				moderation.Reason = post.Moderation.Reason
+				post.Moderation = moderation
+			}
+		}
+		rows.Close()
+	}
+
+	if filters.Unmoderated {
+		for _, post := range posts {
+			if post.Moderation.Removed {
+				post.Labels = append(post.Labels, "removed by moderators")
+			}
+		}
+	}
+
+	if filters.ModeratedBy == "" {
+		return
+	}
+	moderated := make(map[string]bool)
+	rows, err = db.Query(`SELECT channel FROM channel_moderators WHERE pubkey = ?`, filters.ModeratedBy)
+	if err == nil {
+		for rows.Next() {
+			var channel string
+			if rows.Scan(&channel) == nil {
+				moderated[channel] = true
+			}
+		}
+		rows.Close()
+	}
+	for _, post := range posts {
+		post.CanModerate = moderated[post.Channel]
+	}
+}
+
+// isOperator returns true if a pubkey belongs to one of the gateway's operators
+func isOperator(pubkey string) bool {
+	if pubkey == "" {
+		return false
+	}
+
+	for _, operator := range appConfig.Operators {
+		if strings.EqualFold(operator, pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocked returns true if a thread has been locked by a channel moderator or its author
+func isLocked(root string) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM closed_threads WHERE target = ?`, root).Scan(&count)
+	return count > 0
+}
+
+// isRemoved returns true if a post has been removed by a channel moderator
+func isRemoved(id string) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM removed_posts WHERE target = ?`, id).Scan(&count)
+	return count > 0
+}
+
+// upsertModeratorList replaces a pubkey's moderator list for a channel in the DB if the supplied list is newer
+// the list's "d" tag holds the channel name. lists from every pubkey are kept, but only the channel creator's list counts (see the channel_moderators view)
+func upsertModeratorList(moderatorList *schemas.List) error {
+	if moderatorList.D != schemas.SanitizeChannel(moderatorList.D) {
+		return errors.New("invalid channel name")
+	}
+
+	err := upsertList(moderatorList)
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the queryable rows for this list
+	_, err = db.Exec(`DELETE FROM moderators WHERE channel = ? AND owner = ?`, moderatorList.D, moderatorList.PubKey)
+	if err != nil {
+		return err
+	}
+
+	for _, moderator := range moderatorList.Values(schemas.ModeratorTag) {
+		moderator = strings.ToLower(moderator)
+		if !schemas.IsValidFollow(moderator) {
+			continue
+		}
+		db.Exec(`INSERT INTO moderators(channel, owner, moderator) VALUES(?,?,?)`, moderatorList.D, moderatorList.PubKey, moderator)
+	}
+
+	return nil
+}
+
+// insertModerationAction stores a moderation action in the DB
+// actions are kept even if the target post or the moderator's appointment hasn't arrived yet
+func insertModerationAction(action *schemas.ModerationAction) error {
+	_, err := db.Exec(`INSERT INTO moderation_actions(id, pubkey, target, action, reason, expires, front_page, created_at) VALUES(?,?,?,?,?,?,?,?) ON CONFLICT (id) DO NOTHING`,
+		action.ID, action.PubKey, action.Target, action.Action, action.Reason, action.Expires, action.FrontPage, action.CreatedAt)
+	return err
+}
+
+// prependPinned marks pinned posts with their expiry and moves them ahead of the other posts, dropping duplicates
+// front page pins are looked up in the operators' announcements instead of the channel moderators' pins
+func prependPinned(pinned []*schemas.Post, posts []*schemas.Post, frontPage bool) []*schemas.Post {
+	if len(pinned) == 0 {
+		return posts
+	}
+
+	query := `SELECT expires FROM pinned_posts WHERE target = ?`
+	if frontPage {
+		query = `SELECT expires FROM announced_posts WHERE target = ?`
+	}
+
+	seen := map[string]bool{}
+	for _, post := range pinned {
+		post.Pinned = true
+		db.QueryRow(query, post.ID).Scan(&post.PinnedUntil)
+		seen[post.ID] = true
+	}
+
+	for _, post := range posts {
+		if !seen[post.ID] {
+			pinned = append(pinned, post)
+		}
+	}
+
+	return pinned
+}
+
+// recentModerationActions queries the DB and returns the latest moderation actions taken by channel moderators and operators
+func recentModerationActions(limit int) ([]*schemas.ModerationAction, error) {
+	rows, err := db.Query(`SELECT id, pubkey, target, action, reason, expires, front_page, created_at FROM valid_moderation_actions
+		UNION SELECT id, pubkey, target, action, reason, expires, front_page, created_at FROM operator_actions
+		ORDER BY created_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []*schemas.ModerationAction
+	for rows.Next() {
+		action := &schemas.ModerationAction{}
+		err = rows.Scan(&action.ID, &action.PubKey, &action.Target, &action.Action, &action.Reason, &action.Expires, &action.FrontPage, &action.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+
+	return actions, rows.Err()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// muteRoutes sets up mute-related routes
+func muteRoutes(e *echo.Echo) {
+	e.GET("/mutes", isLoggedIn(mutesHandler))
+	e.POST("/mute", isLoggedIn(muteSubmitHandler))
+}
+
+// muteForm defines a mute/unmute request
+type muteForm struct {
+	Tag    string `form:"tag"`    // one of the schemas.MuteTag* values
+	Value  string `form:"value"`  // pubkey, event ID, keyword or channel to mute
+	Unmute bool   `form:"unmute"` // remove the value from the mute list instead of adding it
+}
+
+// mutesHandler serves the logged in user's mute list
+func mutesHandler(c echo.Context) error {
+	var page struct {
+		PubKeys  []string
+		Channels []string
+		Threads  []string
+		Words    []string
+	}
+
+	muteList, _ := muteListForPubkey(c.Get("user").(*schemas.User).PubKey)
+	page.PubKeys = muteList.Values(schemas.MuteTagPubKey)
+	page.Channels = muteList.Values(schemas.MuteTagChannel)
+	page.Threads = muteList.Values(schemas.MuteTagThread)
+	page.Words = muteList.Values(schemas.MuteTagWord)
+
+	pd := new(pageData).Init(c)
+	pd.Title = "Muted"
+	pd.Page = page
+	return c.Render(http.StatusOK, "base:mutes", pd)
+}
+
+// muteSubmitHandler adds or removes an item on the user's mute list and republishes it
+func muteSubmitHandler(c echo.Context) error {
+	form := &muteForm{}
+	if err := c.Bind(form); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	form.Value = schemas.SanitizeMuteValue(form.Tag, form.Value)
+	if !schemas.IsValidMuteTag(form.Tag, form.Value) {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid mute"))
+	}
+
+	// Publish mute list update event
+	err := publishListChange(c, schemas.KindMuteList, "", form.Tag, form.Value, form.Unmute)
+	if err != nil {
+		return serveListChangeError(c, err)
+	}
+
+	// Attempt redirect back to page that the user came from
+	return redirectBack(c, "/mutes")
+}
+
+// muteListForPubkey queries the DB and returns a pubkey's latest mute list
+func muteListForPubkey(pubkey string) (*schemas.List, error) {
+	return listForPubkey(schemas.KindMuteList, pubkey, "")
+}
+
+// upsertMuteList replaces a user's mute list in the DB if the supplied list is newer
+func upsertMuteList(muteList *schemas.List) error {
+	err := upsertList(muteList)
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the queryable rows for this list
+	_, err = db.Exec(`DELETE FROM mutes WHERE pubkey = ?`, muteList.PubKey)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range []string{schemas.MuteTagPubKey, schemas.MuteTagThread, schemas.MuteTagWord, schemas.MuteTagChannel} {
+		for _, value := range muteList.Values(tag) {
+			value = schemas.SanitizeMuteValue(tag, value)
+			if !schemas.IsValidMuteTag(tag, value) {
+				continue
+			}
+			db.Exec(`INSERT INTO mutes(pubkey, tag, value) VALUES(?,?,?)`, muteList.PubKey, tag, value)
+		}
+	}
+
+	invalidateTrustGraphs(muteList.PubKey)
+	return nil
+}
+
+// mutesStmt returns a SQL condition hiding posts muted by the pubkey bound to the numbered parameter
+// uses ?NNN rather than $NNN, which sqlite numbers by order of appearance instead of by value
+func mutesStmt(param int) string {
+	return fmt.Sprintf(`
+		AND posts.pubkey NOT IN (SELECT value FROM mutes WHERE mutes.pubkey = ?%[1]d AND tag = '%[2]s')
+		AND posts.root NOT IN (SELECT value FROM mutes WHERE mutes.pubkey = ?%[1]d AND tag = '%[3]s')
+		AND posts.channel NOT IN (SELECT value FROM mutes WHERE mutes.pubkey = ?%[1]d AND tag = '%[4]s')
+		AND NOT EXISTS (SELECT 1 FROM mutes WHERE mutes.pubkey = ?%[1]d AND tag = '%[5]s' AND (instr(lower(posts.title), value) > 0 OR instr(lower(posts.body), value) > 0))
+	`, param, schemas.MuteTagPubKey, schemas.MuteTagThread, schemas.MuteTagChannel, schemas.MuteTagWord)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	checkErr "github.com/rdbell/nvote/check"
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// nip05Routes sets up NIP-05 related routes
+func nip05Routes(e *echo.Echo) {
+	e.GET("/.well-known/nostr.json", nostrJSONHandler)
+}
+
+// nip05Status defines the cached verification state of a pubkey's NIP-05 identifier
+type nip05Status struct {
+	Identifier string    // identifier claimed in the pubkey's metadata
+	Verified   bool      // whether the identifier's domain vouches for the pubkey
+	CheckedAt  time.Time // time of the last lookup
+}
+
+// nip05Cache holds the latest NIP-05 verification state for each pubkey
+var nip05Cache = struct {
+	sync.RWMutex
+	statuses map[string]*nip05Status
+}{statuses: make(map[string]*nip05Status)}
+
+// nip05Queue is a queue of pubkeys waiting for their NIP-05 identifier to be resolved
+var nip05Queue = make(chan string, 1000)
+
+// nip05Client is the HTTP client used for resolving NIP-05 identifiers
+// NIP-05 forbids following redirects. identifiers are chosen by users, so the client refuses to connect to private addresses
+var nip05Client = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: publicAddressOnly,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// privateNetworks lists the address ranges NIP-05 lookups may not connect to
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		checkErr.Panic(err)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// isPrivateIP returns true if an IP address is loopback, private, link-local or unspecified
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicAddressOnly is a dialer control function that refuses connections to private addresses
+// it runs after DNS resolution, so host names that resolve to private addresses are refused too
+func publicAddressOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivateIP(ip) {
+		return errors.New("refusing to connect to " + host)
+	}
+	return nil
+}
+
+// nostrJSON defines the /.well-known/nostr.json response
+type nostrJSON struct {
+	Names map[string]string `json:"names"`
+}
+
+// checkNIP05Identifiers resolves queued NIP-05 identifiers and periodically re-checks known identifiers
+func checkNIP05Identifiers() {
+	interval := time.Duration(appConfig.NIP05RecheckMinutes) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	// Periodically re-queue every known identifier
+	go func() {
+		for range time.Tick(interval) {
+			nip05Cache.RLock()
+			pubkeys := make([]string, 0, len(nip05Cache.statuses))
+			for pubkey := range nip05Cache.statuses {
+				pubkeys = append(pubkeys, pubkey)
+			}
+			nip05Cache.RUnlock()
+
+			for _, pubkey := range pubkeys {
+				nip05Queue <- pubkey
+			}
+		}
+	}()
+
+	for pubkey := range nip05Queue {
+		nip05Cache.RLock()
+		status, ok := nip05Cache.statuses[pubkey]
+		identifier := ""
+		if ok {
+			identifier = status.Identifier
+		}
+		nip05Cache.RUnlock()
+
+		if identifier == "" {
+			continue
+		}
+
+		resolved, err := resolveNIP05(identifier)
+		verified := err == nil && resolved == pubkey
+
+		nip05Cache.Lock()
+		// Skip the update if the identifier changed while resolving
+		if status, ok := nip05Cache.statuses[pubkey]; ok && status.Identifier == identifier {
+			status.Verified = verified
+			status.CheckedAt = time.Now()
+		}
+		nip05Cache.Unlock()
+	}
+}
+
+// queueNIP05Check records a pubkey's NIP-05 identifier and queues it for verification
+func queueNIP05Check(pubkey string, identifier string) {
+	nip05Cache.Lock()
+	defer nip05Cache.Unlock()
+
+	if identifier == "" {
+		delete(nip05Cache.statuses, pubkey)
+		return
+	}
+
+	// Already known, leave it to the periodic re-check
+	if status, ok := nip05Cache.statuses[pubkey]; ok && status.Identifier == identifier {
+		return
+	}
+
+	nip05Cache.statuses[pubkey] = &nip05Status{Identifier: identifier}
+
+	// Don't block event ingestion if the queue is full. The periodic re-check will pick it up
+	select {
+	case nip05Queue <- pubkey:
+	default:
+	}
+}
+
+// verifiedNIP05 returns a pubkey's NIP-05 identifier if it has been verified
+func verifiedNIP05(pubkey string) string {
+	nip05Cache.RLock()
+	defer nip05Cache.RUnlock()
+
+	status, ok := nip05Cache.statuses[pubkey]
+	if !ok || !status.Verified {
+		return ""
+	}
+
+	return status.Identifier
+}
+
+// resolveNIP05 returns the pubkey that an identifier's domain lists for the identifier's name
+func resolveNIP05(identifier string) (string, error) {
+	name, domain, err := schemas.ParseNIP05(identifier)
+	if err != nil {
+		return "", err
+	}
+
+	// Names on this gateway's domain can be resolved without an HTTP round trip
+	if domain == siteHost() {
+		return localNIP05Pubkey(name)
+	}
+
+	response, err := nip05Client.Get("https://" + domain + "/.well-known/nostr.json?name=" + url.QueryEscape(name))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New("unexpected status from " + domain)
+	}
+
+	result := &nostrJSON{}
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(result)
+	if err != nil {
+		return "", err
+	}
+
+	pubkey, ok := result.Names[name]
+	if !ok {
+		return "", errors.New("name not found")
+	}
+
+	return strings.ToLower(pubkey), nil
+}
+
+// siteHost returns the host portion of the configured site URL
+func siteHost() string {
+	return schemas.SiteHost()
+}
+
+// nip05Names holds the NIP-05 names file open for appending claims and releases
+var nip05Names = struct {
+	sync.Mutex
+	file *os.File
+}{}
+
+// loadNIP05Names reads the NIP-05 names file into the DB and opens it for appending
+// each line holds a name, the pubkey that claimed it and the claiming metadata's timestamp, or just a name that was released.
+// names go to the first pubkey this gateway sees claim them, and the file keeps that order across restarts
+func loadNIP05Names() {
+	if appConfig.NIP05NamesFile == "" {
+		return
+	}
+
+	file, err := os.OpenFile(appConfig.NIP05NamesFile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		panic("unable to open NIP-05 names file: " + err.Error())
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 1 {
+			_, err = db.Exec(`DELETE FROM nip05_names WHERE name = ?`, fields[0])
+			checkErr.Panic(err)
+			continue
+		}
+		if len(fields) != 3 {
+			continue
+		}
+		createdAt, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		_, err = db.Exec(`INSERT INTO nip05_names(name, pubkey, created_at) VALUES(?,?,?) ON CONFLICT (name) DO UPDATE SET pubkey=excluded.pubkey, created_at=excluded.created_at`,
+			fields[0], fields[1], createdAt)
+		checkErr.Panic(err)
+	}
+
+	nip05Names.file = file
+
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM nip05_names`).Scan(&count)
+	log.Printf("loaded %d NIP-05 names\n", count)
+}
+
+// claimNIP05Name registers a name on this gateway's domain for a pubkey
+// names are first come, first served in the order this gateway sees the claims. event timestamps are chosen by the sender,
+// so they never decide who gets a name, and a claimed name is only freed by newer metadata from the pubkey holding it
+func claimNIP05Name(metadata *schemas.Metadata) {
+	nip05Names.Lock()
+	defer nip05Names.Unlock()
+
+	name := nip05LocalName(metadata.NIP05)
+
+	// Release any name this pubkey claimed before this metadata, and no longer claims
+	var released []string
+	rows, err := db.Query(`SELECT name FROM nip05_names WHERE pubkey = ? AND name != ? AND created_at < ?`, metadata.PubKey, name, metadata.CreatedAt)
+	if err == nil {
+		for rows.Next() {
+			var old string
+			if rows.Scan(&old) == nil {
+				released = append(released, old)
+			}
+		}
+		rows.Close()
+	}
+	for _, old := range released {
+		if _, err := db.Exec(`DELETE FROM nip05_names WHERE name = ?`, old); err == nil && nip05Names.file != nil {
+			fmt.Fprintf(nip05Names.file, "%s\n", old)
+		}
+	}
+
+	if name == "" {
+		return
+	}
+
+	result, err := db.Exec(`INSERT INTO nip05_names(name, pubkey, created_at) VALUES(?,?,?) ON CONFLICT (name) DO NOTHING`, name, metadata.PubKey, metadata.CreatedAt)
+	if err != nil {
+		return
+	}
+	if claimed, _ := result.RowsAffected(); claimed > 0 && nip05Names.file != nil {
+		fmt.Fprintf(nip05Names.file, "%s %s %d\n", name, metadata.PubKey, metadata.CreatedAt)
+	}
+}
+
+// nip05LocalName returns the name part of an identifier if it belongs to this gateway's domain
+func nip05LocalName(identifier string) string {
+	name, domain, err := schemas.ParseNIP05(identifier)
+	if err != nil || domain != siteHost() {
+		return ""
+	}
+	return name
+}
+
+// localNIP05Pubkey returns the pubkey that claimed a name on this gateway's domain
+func localNIP05Pubkey(name string) (string, error) {
+	pubkey := ""
+	err := db.QueryRow(`SELECT pubkey FROM nip05_names WHERE name = ?`, name).Scan(&pubkey)
+	if err != nil {
+		return "", err
+	}
+	return pubkey, nil
+}
+
+// nostrJSONHandler serves the NIP-05 names claimed on this gateway's domain
+func nostrJSONHandler(c echo.Context) error {
+	result := &nostrJSON{Names: make(map[string]string)}
+
+	// NIP-05 clients fetch this document from browsers
+	c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
+
+	name := strings.ToLower(c.QueryParam("name"))
+	if name != "" {
+		if pubkey, err := localNIP05Pubkey(name); err == nil {
+			result.Names[name] = pubkey
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+
+	rows, err := db.Query(`SELECT name, pubkey FROM nip05_names`)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, result)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, pubkey string
+		if rows.Scan(&name, &pubkey) == nil {
+			result.Names[name] = pubkey
+		}
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/rdbell/nvote/schemas"
+)
+
+func TestParseNIP05(t *testing.T) {
+	tests := []struct {
+		identifier string
+		valid      bool
+	}{
+		{"alice@example.com", true},
+		{"_@example.com", true},
+		{"alice@sub.example.co.uk", true},
+		{"Alice@Example.com", true},
+		{"alice@localhost:1323", true}, // the gateway's own domain in the dev config
+		{"alice@localhost", false},
+		{"alice@example.com:8080", false},
+		{"alice@127.0.0.1", false},
+		{"alice@10.0.0.1", false},
+		{"alice@[::1]", false},
+		{"alice@example", false},
+		{"alice", false},
+		{"@example.com", false},
+	}
+
+	for _, test := range tests {
+		_, _, err := schemas.ParseNIP05(test.identifier)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("ParseNIP05(%q) valid = %v, want %v (err %v)", test.identifier, valid, test.valid, err)
+		}
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"93.184.216.34", false},
+		{"2606:4700::1111", false},
+	}
+
+	for _, test := range tests {
+		if private := isPrivateIP(net.ParseIP(test.ip)); private != test.private {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", test.ip, private, test.private)
+		}
+	}
+
+	if err := publicAddressOnly("tcp", "127.0.0.1:80", nil); err == nil {
+		t.Error("publicAddressOnly allowed a loopback address")
+	}
+	if err := publicAddressOnly("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("publicAddressOnly refused a public address: %v", err)
+	}
+}
+
+func TestClaimNIP05Name(t *testing.T) {
+	first := strings.Repeat("a", 64)
+	second := strings.Repeat("b", 64)
+	identifier := "claimtest@" + siteHost()
+	defer db.Exec(`DELETE FROM nip05_names WHERE pubkey IN (?,?)`, first, second)
+
+	claimNIP05Name(&schemas.Metadata{PubKey: first, NIP05: identifier, CreatedAt: 2000})
+
+	// A later-arriving claim can't take the name, even when it's dated earlier
+	claimNIP05Name(&schemas.Metadata{PubKey: second, NIP05: identifier, CreatedAt: 1000})
+	if pubkey, _ := localNIP05Pubkey("claimtest"); pubkey != first {
+		t.Fatalf("name held by %q after a backdated claim, want the first claimant", pubkey)
+	}
+
+	// Metadata dated before the claim doesn't release it
+	claimNIP05Name(&schemas.Metadata{PubKey: first, NIP05: "", CreatedAt: 1500})
+	if pubkey, _ := localNIP05Pubkey("claimtest"); pubkey != first {
+		t.Fatalf("name released by older metadata, held by %q", pubkey)
+	}
+
+	// Newer metadata without the name releases it, and the next claim gets it
+	claimNIP05Name(&schemas.Metadata{PubKey: first, NIP05: "", CreatedAt: 3000})
+	if pubkey, _ := localNIP05Pubkey("claimtest"); pubkey != "" {
+		t.Fatalf("name still held by %q after being released", pubkey)
+	}
+	claimNIP05Name(&schemas.Metadata{PubKey: second, NIP05: identifier, CreatedAt: 1000})
+	if pubkey, _ := localNIP05Pubkey("claimtest"); pubkey != second {
+		t.Fatalf("name held by %q after release, want the next claimant", pubkey)
+	}
+
+	// Names on other domains are never claimed
+	claimNIP05Name(&schemas.Metadata{PubKey: first, NIP05: "othertest@example.com", CreatedAt: 4000})
+	if pubkey, _ := localNIP05Pubkey("othertest"); pubkey != "" {
+		t.Fatalf("name on another domain claimed by %q", pubkey)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rdbell/go-nostr"
 	"github.com/rdbell/nvote/schemas"
@@ -78,13 +79,12 @@ func searchHandler(c echo.Context) error {
 	// TODO: search within channel
 	// TODO: paginate search results
 	var err error
-	page.Posts, err = fetchPosts(&schemas.PostFilterset{
+	page.Posts, err = fetchPosts(userFilters(c, &schemas.PostFilterset{
 		PostContains:  page.Query,
 		PostType:      schemas.PostTypePosts,
-		HideBadUsers:  c.Get("user").(*schemas.User).HideBadUsers,
 		OrderByColumn: "created_at",
 		Limit:         appConfig.PostsPerPage * 2,
-	})
+	}))
 
 	if err != nil {
 		return serveError(c, http.StatusInternalServerError, err)
@@ -93,13 +93,12 @@ func searchHandler(c echo.Context) error {
 	// Fetch comments ordered by recent
 	// TODO: search within channel
 	// TODO: paginate search results
-	page.Comments, err = fetchPosts(&schemas.PostFilterset{
+	page.Comments, err = fetchPosts(userFilters(c, &schemas.PostFilterset{
 		PostContains:  page.Query,
 		PostType:      schemas.PostTypeComments,
-		HideBadUsers:  c.Get("user").(*schemas.User).HideBadUsers,
 		OrderByColumn: "created_at",
 		Limit:         appConfig.PostsPerPage * 2,
-	})
+	}))
 
 	if err != nil {
 		return serveError(c, http.StatusInternalServerError, err)
@@ -124,16 +123,39 @@ func searchHandler(c echo.Context) error {
 	return c.Render(http.StatusOK, "base:search", pd)
 }
 
-// viewPostsHandler serves all posts, or the posts for a channel
+// viewPostsHandler serves all posts, or the posts for a channel, hashtag or linked domain
 func viewPostsHandler(c echo.Context) error {
 	var page struct {
-		Posts     []*schemas.Post
-		Channel   string
-		Page      int
-		UserVotes []*schemas.Vote
+		Posts      []*schemas.Post
+		Channel    string
+		Hashtag    string
+		Flair      string
+		Domain     string
+		Subscribed bool
+		Sidebar    *channelSidebar
+		Page       int
+		UserVotes  []*schemas.Vote
 	}
 
 	page.Channel = c.Param("channel")
+	page.Hashtag = schemas.SanitizeHashtag(c.Param("tag"))
+	if c.Param("tag") != "" && page.Hashtag == "" {
+		return serveError(c, http.StatusNotFound, errors.New("invalid hashtag"))
+	}
+	page.Domain = sanitizeDomain(c.Param("host"))
+	if c.Param("host") != "" && page.Domain == "" {
+		return serveError(c, http.StatusNotFound, errors.New("invalid domain"))
+	}
+	if page.Channel != "" {
+		page.Flair = schemas.SanitizeFlair(c.QueryParam("flair"))
+	}
+	if reason, blocked := blockReason(blockTypeChannel, schemas.SanitizeChannel(page.Channel)); blocked {
+		return removedByGateway(c, reason)
+	}
+
+	// The personal front page only shows channels the user subscribes to
+	subscribedBy, _ := c.Get("subscribedBy").(string)
+	page.Subscribed = subscribedBy != ""
 	page.Page, _ = strconv.Atoi(c.FormValue("page"))
 
 	// Sanitize page number
@@ -143,19 +165,46 @@ func viewPostsHandler(c echo.Context) error {
 
 	// Fetch posts ordered by ranking
 	var err error
-	page.Posts, err = fetchPosts(&schemas.PostFilterset{
+	page.Posts, err = fetchPosts(userFilters(c, &schemas.PostFilterset{
 		Channel:       page.Channel,
 		PostType:      schemas.PostTypePosts,
-		HideBadUsers:  c.Get("user").(*schemas.User).HideBadUsers,
+		SubscribedBy:  subscribedBy,
+		Hashtag:       page.Hashtag,
+		Flair:         page.Flair,
+		Domain:        page.Domain,
 		Page:          page.Page,
 		OrderByColumn: "ranking",
 		Limit:         appConfig.PostsPerPage,
-	})
+	}))
 
 	if err != nil {
 		return serveError(c, http.StatusInternalServerError, err)
 	}
 
+	// Posts pinned by the channel's moderators, or by the gateway's operators on the front page, go at the top of the first page
+	// hashtag, flair and domain listings aren't pinned
+	if page.Page == 0 && page.Hashtag == "" && page.Flair == "" && page.Domain == "" {
+		pinFilters := &schemas.PostFilterset{
+			PostType:      schemas.PostTypePosts,
+			OrderByColumn: "created_at",
+		}
+		name := schemas.SanitizeChannel(page.Channel)
+		if page.Channel == "" {
+			pinFilters.Announced = true
+		} else if name != "" {
+			pinFilters.Channel = name
+			pinFilters.Pinned = true
+		}
+
+		if pinFilters.Announced || pinFilters.Pinned {
+			pinned, err := fetchPosts(userFilters(c, pinFilters))
+			if err != nil {
+				return serveError(c, http.StatusInternalServerError, err)
+			}
+			page.Posts = prependPinned(pinned, page.Posts, pinFilters.Announced)
+		}
+	}
+
 	// Fetch all votes for this user, to disable votes for posts that have already been voted on
 	if c.Get("user").(*schemas.User).PubKey != "" {
 		var err error
@@ -168,6 +217,14 @@ func viewPostsHandler(c echo.Context) error {
 		}
 	}
 
+	// Channel pages get a sidebar describing the channel
+	if name := schemas.SanitizeChannel(page.Channel); name != "" && !page.Subscribed {
+		page.Sidebar, err = sidebarForChannel(name)
+		if err != nil {
+			return serveError(c, http.StatusInternalServerError, err)
+		}
+	}
+
 	pd := new(pageData).Init(c)
 	pd.Title = pd.Config.Tagline
 	pd.Page = page
@@ -182,7 +239,16 @@ func fetchPosts(filters *schemas.PostFilterset) ([]*schemas.Post, error) {
 	pubkeyStmt := " AND $2 = $2"
 	postContainsStmt := " AND $3 = $3"
 	postTypeStmt := ""
-	badUsersStmt := ""
+	badUsersStmt := thresholdsStmt(filters)
+	downvotedStmt := ""
+	mutedStmt := " AND ?8 = ?8"
+	followedStmt := " AND ?9 = ?9"
+	subscribedStmt := " AND ?10 = ?10"
+	trustStmt := " AND ?11 = ?11"
+	hashtagStmt := " AND ?12 = ?12"
+	flairStmt := " AND ?13 = ?13"
+	domainStmt := " AND ?14 = ?14"
+	moderationStmt := removedStmt
 	pageStmt := ""
 	orderByStmt := ""
 	limitStmt := ""
@@ -216,9 +282,49 @@ func fetchPosts(filters *schemas.PostFilterset) ([]*schemas.Post, error) {
 			return nil, errors.New("invalid value for OrderedByColumn")
 		}
 		orderByStmt = fmt.Sprintf(" ORDER BY %s DESC", filters.OrderByColumn)
+		if filters.OrderByColumn == "score" {
+			orderByStmt = fmt.Sprintf(" ORDER BY %s DESC", scoreColumn())
+		}
+
+		// Personalized feeds only count votes from the viewer's web of trust
+		if filters.TrustedBy != "" && filters.OrderByColumn == "ranking" {
+			orderByStmt = fmt.Sprintf(" ORDER BY trusted_ranking(%s, created_at, pow, parent) DESC", trustedScoreStmt(11))
+		} else if filters.TrustedBy != "" && filters.OrderByColumn == "score" {
+			orderByStmt = fmt.Sprintf(" ORDER BY %s DESC", trustedScoreStmt(11))
+		}
+	}
+	if filters.HideDownvoted {
+		downvotedStmt = fmt.Sprintf(" AND score >= %d", filters.MinPostScore)
+	}
+	if filters.MutedBy != "" {
+		mutedStmt = mutesStmt(8)
 	}
-	if filters.HideBadUsers {
-		badUsersStmt = " AND user_score > -20 "
+	if filters.FollowedBy != "" {
+		followedStmt = " AND posts.pubkey IN (SELECT target FROM follows WHERE follows.pubkey = ?9)"
+	}
+	if filters.SubscribedBy != "" {
+		subscribedStmt = " AND posts.channel IN (SELECT channel FROM subscriptions WHERE subscriptions.pubkey = ?10)"
+	}
+	if filters.TrustedBy != "" {
+		trustStmt = trustedStmt(11)
+	}
+	if filters.Hashtag != "" {
+		hashtagStmt = " AND posts.id IN (SELECT post_id FROM post_tags WHERE tag = ?12 AND NOT flair)"
+	}
+	if filters.Flair != "" {
+		flairStmt = " AND posts.id IN (SELECT post_id FROM post_flair WHERE flair = ?13)"
+	}
+	if filters.Domain != "" {
+		domainStmt = " AND (posts.domain = ?14 OR posts.domain LIKE '%.' || ?14) AND posts.crosspost = ''"
+	}
+	if filters.Unmoderated {
+		moderationStmt = ""
+	}
+	if filters.Pinned {
+		moderationStmt += pinnedStmt
+	}
+	if filters.Announced {
+		moderationStmt += announcedStmt
 	}
 	if filters.Limit > 0 {
 		limitStmt = fmt.Sprintf(" LIMIT %d", filters.Limit)
@@ -228,10 +334,10 @@ func fetchPosts(filters *schemas.PostFilterset) ([]*schemas.Post, error) {
 	}
 
 	rows, err := db.Query(fmt.Sprintf(`
-		SELECT id, score, children, pubkey, created_at, title, body, channel, parent
+		SELECT id, score, weighted_score, children, pubkey, created_at, title, body, channel, parent, crosspost
 		FROM posts WHERE TRUE
-		%s%s%s%s%s%s%s%s
-	`, channelStmt, pubkeyStmt, postContainsStmt, postTypeStmt, badUsersStmt, orderByStmt, limitStmt, pageStmt), filters.Channel, filters.PubKey, filters.PostContains, pc1, pc2, pc3, pc4)
+		%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s
+	`, channelStmt, pubkeyStmt, postContainsStmt, postTypeStmt, badUsersStmt, downvotedStmt, hiddenStmt, moderationStmt, mutedStmt, followedStmt, subscribedStmt, trustStmt, hashtagStmt, flairStmt, domainStmt, orderByStmt, limitStmt, pageStmt), filters.Channel, filters.PubKey, filters.PostContains, pc1, pc2, pc3, pc4, filters.MutedBy, filters.FollowedBy, filters.SubscribedBy, filters.TrustedBy, filters.Hashtag, filters.Flair, filters.Domain)
 	if err != nil {
 		return nil, err
 	}
@@ -239,22 +345,53 @@ func fetchPosts(filters *schemas.PostFilterset) ([]*schemas.Post, error) {
 	var posts []*schemas.Post
 	for rows.Next() {
 		post := &schemas.Post{}
-		err = rows.Scan(&post.ID, &post.Score, &post.Children, &post.PubKey, &post.CreatedAt, &post.Title, &post.Body, &post.Channel, &post.Parent)
+		err = rows.Scan(&post.ID, &post.Score, &post.WeightedScore, &post.Children, &post.PubKey, &post.CreatedAt, &post.Title, &post.Body, &post.Channel, &post.Parent, &post.Crosspost)
 		if err != nil {
 			return nil, err
 		}
 		posts = append(posts, post)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-	return posts, err
+	annotatePosts(posts, filters)
+	return posts, nil
+}
+
+// annotatePosts fills the labels, tags, moderation state and viewer permissions of a page's posts
+// they're batch loaded for the whole page, rather than queried per post while rendering
+func annotatePosts(posts []*schemas.Post, filters *schemas.PostFilterset) {
+	if len(posts) == 0 {
+		return
+	}
+
+	labelPosts(posts)
+	tagPosts(posts)
+	moderatePosts(posts, filters)
+}
+
+// postsByID indexes posts by ID, and returns the SQL placeholders and arguments for matching their IDs with IN
+func postsByID(posts []*schemas.Post) (map[string][]*schemas.Post, string, []interface{}) {
+	byID := make(map[string][]*schemas.Post)
+	args := make([]interface{}, 0, len(posts))
+	for _, post := range posts {
+		if _, ok := byID[post.ID]; !ok {
+			args = append(args, post.ID)
+		}
+		byID[post.ID] = append(byID[post.ID], post)
+	}
+
+	return byID, strings.TrimSuffix(strings.Repeat("?,", len(args)), ","), args
 }
 
 // newPostHandler serves the New Post page
 func newPostHandler(c echo.Context) error {
 	var page struct {
-		Post      *schemas.Post
-		Parent    *schemas.Post
-		UserVotes []*schemas.Vote
+		Post       *schemas.Post
+		Parent     *schemas.Post
+		UserVotes  []*schemas.Vote
+		Duplicates []*schemas.Post
 	}
 	page.Post = &schemas.Post{}
 	page.Post.Channel = c.Param("channel")
@@ -274,9 +411,22 @@ func newPostHandler(c echo.Context) error {
 
 	// Handle POST request for post preview
 	if c.Bind(page.Post) != nil || (!page.Post.IsValidPost() && !page.Post.IsValidComment()) {
-		page.Post = &schemas.Post{}
+		page.Post = &schemas.Post{Channel: c.Param("channel")}
+	}
+	page.Post.Hashtags = schemas.SanitizeHashtags(page.Post.Hashtags)
+
+	// Crossposts start from the original post's title and content
+	if id := c.Param("id"); id != "" {
+		original, err := crosspostOrigin(id)
+		if err != nil {
+			return serveError(c, http.StatusNotFound, errors.New("not found"))
+		}
+		page.Post = &schemas.Post{Title: original.Title, Body: original.Body, Channel: schemas.SanitizeChannel(c.QueryParam("channel")), Crosspost: original.ID}
 	}
 
+	// Warn about links that have already been submitted
+	page.Duplicates = duplicateLinks(page.Post)
+
 	parentID := c.Param("parent")
 	if page.Post.Parent != "" {
 		parentID = page.Post.Parent
@@ -284,6 +434,9 @@ func newPostHandler(c echo.Context) error {
 
 	pd := new(pageData).Init(c)
 	pd.Title = "New Post"
+	if page.Post.Crosspost != "" {
+		pd.Title = "Crosspost"
+	}
 
 	// Fill parent info
 	if parentID != "" {
@@ -293,6 +446,10 @@ func newPostHandler(c echo.Context) error {
 		if err != nil || page.Parent == nil {
 			return serveError(c, http.StatusNotFound, errors.New("not found"))
 		}
+		annotatePosts([]*schemas.Post{page.Parent}, userFilters(c, &schemas.PostFilterset{}))
+		if status := page.Parent.Moderation.Status(); status != "" {
+			return serveError(c, http.StatusUnauthorized, errors.New("this thread is "+status))
+		}
 	}
 
 	pd.Page = page
@@ -307,15 +464,41 @@ func newPostSubmitHandler(c echo.Context) error {
 		return serveError(c, http.StatusInternalServerError, errors.New("invalid post"))
 	}
 
+	// Locked and archived threads don't accept new replies
+	if post.Parent != "" {
+		if status := threadStatus(post.Parent); status != "" {
+			return serveError(c, http.StatusUnauthorized, errors.New("this thread is "+status))
+		}
+	}
+
+	// Crossposts carry the original post's content to another channel
+	// other links that have already been submitted go back to the form, unless the user chose to submit anyway
+	if post.Crosspost != "" && post.Parent == "" {
+		original, err := crosspostOrigin(post.Crosspost)
+		if err != nil {
+			return serveError(c, http.StatusNotFound, errors.New("not found"))
+		}
+		if schemas.SanitizeChannel(post.Channel) == original.Channel {
+			return serveError(c, http.StatusInternalServerError, errors.New("crossposts must go to a different channel"))
+		}
+		post.Crosspost = original.ID
+		post.Body = original.Body
+	} else if c.FormValue("allow_duplicate") != "true" && len(duplicateLinks(post)) > 0 {
+		return newPostHandler(c)
+	}
+
 	// Format and serialize post
 	post.PrepareForPublish()
+	if post.Flair != "" && !hasFlair(post.Channel, post.Flair) {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid flair"))
+	}
 	content, err := json.Marshal(post)
 	if err != nil {
 		return serveError(c, http.StatusInternalServerError, err)
 	}
 
-	// Publish
-	event, err := publishEvent(c, content, nostr.KindTextNote, nil)
+	// Publish with the post's hashtags as NIP-12 "t" tags
+	event, err := publishEvent(c, content, nostr.KindTextNote, post.Tags())
 	if err != nil {
 		return serveError(c, http.StatusInternalServerError, err)
 	}
@@ -356,21 +539,26 @@ func viewPostHandler(c echo.Context) error {
 	}
 
 	var page struct {
-		ID        string
-		Posts     []*schemas.Post
-		UserVotes []*schemas.Vote
+		ID         string
+		Posts      []*schemas.Post
+		UserVotes  []*schemas.Vote
+		Moderation *schemas.PostModeration
 	}
 	page.ID = id
 
 	// Get post tree
-	posts := getPostTree(page.ID, 0)
+	posts := getPostTree(page.ID, 0, userFilters(c, &schemas.PostFilterset{}))
 	for _, post := range posts {
 		page.Posts = append(page.Posts, post)
 	}
 
 	if len(posts) == 0 {
+		if reason, blocked := blockedPostReason(page.ID); blocked {
+			return removedByGateway(c, reason)
+		}
 		return serveError(c, http.StatusNotFound, errors.New("not found"))
 	}
+	page.Moderation = &posts[0].Moderation
 
 	// Fetch all votes for this user, to disable votes for posts that have already been voted on
 	if c.Get("user").(*schemas.User).PubKey != "" {
@@ -390,12 +578,51 @@ func viewPostHandler(c echo.Context) error {
 	return c.Render(http.StatusOK, "base:view_post", pd)
 }
 
+// thresholdsStmt returns a SQL condition applying a filterset's author score and account age thresholds
+func thresholdsStmt(filters *schemas.PostFilterset) string {
+	stmt := ""
+
+	// The web of trust replaces the global user score
+	// channel listings judge authors by their karma in that channel instead
+	if filters.HideBadUsers && filters.TrustedBy == "" {
+		if filters.Channel != "" && filters.Channel != "all" {
+			stmt += channelKarmaStmt(filters.MinAuthorScore)
+		} else {
+			stmt += fmt.Sprintf(" AND user_score >= %d", filters.MinAuthorScore)
+		}
+	}
+	if filters.NewAccountCutoff > 0 {
+		stmt += fmt.Sprintf(" AND posts.pubkey IN (SELECT pubkey FROM users WHERE first_seen <= %d)", filters.NewAccountCutoff)
+	}
+
+	return stmt
+}
+
+// userFilters applies the user's spam filter thresholds, mutes and web of trust to a filterset
+func userFilters(c echo.Context, filters *schemas.PostFilterset) *schemas.PostFilterset {
+	user := c.Get("user").(*schemas.User)
+
+	filters.HideBadUsers = user.HideBadUsers
+	filters.MinAuthorScore = user.MinAuthorScore
+	filters.HideDownvoted = user.HideDownvoted
+	filters.MinPostScore = user.MinPostScore
+	if user.HideNewAccounts {
+		filters.NewAccountCutoff = uint32(time.Now().AddDate(0, 0, -user.MinAccountAgeDays).Unix())
+	}
+	filters.MutedBy = user.PubKey
+	filters.TrustedBy = trustedBy(c)
+	filters.Unmoderated = user.ShowUnmoderated
+	filters.ModeratedBy = user.PubKey
+
+	return filters
+}
+
 // getPost queries the DB to return a single post with a specified ID
 func getPost(id string) (*schemas.Post, error) {
 	// Get post
 	post := &schemas.Post{}
-	err := db.QueryRow(`SELECT id, score, children, pubkey, created_at, title, body, channel, parent FROM posts WHERE id = ?`, id).Scan(
-		&post.ID, &post.Score, &post.Children, &post.PubKey, &post.CreatedAt, &post.Title, &post.Body, &post.Channel, &post.Parent,
+	err := db.QueryRow(`SELECT id, score, weighted_score, children, pubkey, created_at, title, body, channel, parent, crosspost FROM posts WHERE id = ?`, id).Scan(
+		&post.ID, &post.Score, &post.WeightedScore, &post.Children, &post.PubKey, &post.CreatedAt, &post.Title, &post.Body, &post.Channel, &post.Parent, &post.Crosspost,
 	)
 
 	if err != nil {
@@ -405,33 +632,65 @@ func getPost(id string) (*schemas.Post, error) {
 	return post, nil
 }
 
+// postExists returns true if a post with the ID is already stored
+func postExists(id string) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM posts WHERE id = ?`, id).Scan(&count)
+	return count > 0
+}
+
 // getPostTree recursively queries the DB to return a post and all of its children
+// children hidden by filters are skipped along with their replies
 // TODO: switch to WITH RECURSIVE ... SELECT?
-func getPostTree(id string, depth int) []*schemas.Post {
+func getPostTree(id string, depth int, filters *schemas.PostFilterset) []*schemas.Post {
 	var posts []*schemas.Post
 
 	// Get parent post
 	if depth == 0 {
 		post, err := getPost(id)
-		if err != nil || post == nil {
+		if err != nil || post == nil || isHidden(id) {
+			return nil
+		}
+		if isRemoved(id) && !filters.Unmoderated {
 			return nil
 		}
 		posts = append(posts, post)
 	}
 
+	mutedStmt := " AND ?2 = ?2"
+	if filters.MutedBy != "" {
+		mutedStmt = mutesStmt(2)
+	}
+	trustStmt := " AND ?3 = ?3"
+	orderByStmt := scoreColumn()
+	if filters.TrustedBy != "" {
+		trustStmt = trustedStmt(3)
+		orderByStmt = trustedScoreStmt(3)
+	}
+	moderationStmt := removedStmt + lockedStmt
+	if filters.Unmoderated {
+		moderationStmt = ""
+	}
+
 	// TODO: change this to 'ORDER BY ranking' later when there's more activity
-	rows, err := db.Query(fmt.Sprintf(`SELECT id, score, children, pubkey, created_at, title, body, parent FROM posts WHERE parent = ? ORDER BY score DESC`), id)
+	// Downvoted comments are collapsed by the template rather than hidden
+	rows, err := db.Query(fmt.Sprintf(`SELECT id, score, weighted_score, children, pubkey, created_at, title, body, channel, parent FROM posts WHERE parent = $1%s%s%s%s%s ORDER BY %s DESC`, hiddenStmt, moderationStmt, mutedStmt, trustStmt, thresholdsStmt(filters), orderByStmt), id, filters.MutedBy, filters.TrustedBy)
 	if err != nil {
 		return posts
 	}
 
 	for rows.Next() {
 		post := &schemas.Post{}
-		err = rows.Scan(&post.ID, &post.Score, &post.Children, &post.PubKey, &post.CreatedAt, &post.Title, &post.Body, &post.Parent)
+		err = rows.Scan(&post.ID, &post.Score, &post.WeightedScore, &post.Children, &post.PubKey, &post.CreatedAt, &post.Title, &post.Body, &post.Channel, &post.Parent)
 		posts = append(posts, post)
 
 		// Also get child's children
-		posts = append(posts, getPostTree(post.ID, depth+1)...)
+		posts = append(posts, getPostTree(post.ID, depth+1, filters)...)
+	}
+
+	// The whole tree is annotated at once
+	if depth == 0 {
+		annotatePosts(posts, filters)
 	}
 
 	return posts
@@ -439,12 +698,15 @@ func getPostTree(id string, depth int) []*schemas.Post {
 
 // insertPost inserts a post into the DB
 func insertPost(post *schemas.Post) error {
-	// Fill channel field for replies
+	// Fill channel and thread root fields for replies
+	root := post.ID
 	if post.IsValidComment() {
 		post.Channel = ""
+		root = ""
 		parent, err := getOP(post.Parent)
 		if err == nil {
 			post.Channel = parent.Channel
+			root = parent.ID
 		}
 	}
 
@@ -462,12 +724,29 @@ func insertPost(post *schemas.Post) error {
 		}
 	}
 
+	// Link posts are indexed by canonical URL and domain for duplicate detection and domain listings
+	link, domain := "", ""
+	if post.Parent == "" {
+		link, domain = canonicalURL(post.Body), linkHost(post.Body)
+	}
+
+	if post.PostedAt < post.CreatedAt {
+		post.PostedAt = post.CreatedAt
+	}
+
+	// Crossposts are checked against their original, which may not have arrived yet
+	pendingCrosspost := verifyCrosspost(post)
+
 	// Add to DB
-	_, err = db.Exec(`INSERT INTO posts(id, score, user_score, ranking, children, pubkey, created_at, title, body, channel, parent) VALUES(?,?,?,?,?,?,?,?,?,?,?)`, post.ID, 0, userScore, reddit(post.Score, post.CreatedAt), 0, post.PubKey, post.CreatedAt, post.Title, post.Body, post.Channel, post.Parent)
+	_, err = db.Exec(`INSERT INTO posts(id, score, weighted_score, user_score, ranking, children, pubkey, created_at, posted_at, title, body, channel, parent, root, pow, crosspost, pending_crosspost, link, domain) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`, post.ID, 0, 0, userScore, postRanking(0, post.CreatedAt, post.PoW, post.Parent), 0, post.PubKey, post.CreatedAt, post.PostedAt, post.Title, post.Body, post.Channel, post.Parent, root, post.PoW, post.Crosspost, pendingCrosspost, link, domain)
 	if err != nil {
 		return err
 	}
 
+	if err = confirmCrossposts(post); err != nil {
+		return err
+	}
+
 	// Update parent's children count
 	if post.Parent != "" {
 		updateChildrenCounts(post.Parent)
@@ -496,6 +775,7 @@ func deletePost(event *nostr.Event) error {
 
 		// delete targets
 		db.Exec(`DELETE FROM posts WHERE pubkey = ? AND id = ?`, event.PubKey, event.Tags[0][1].(string))
+		db.Exec(`DELETE FROM post_tags WHERE post_id = ? AND post_id NOT IN (SELECT id FROM posts)`, event.Tags[0][1].(string))
 
 		// TODO: update parent reply count recursively?
 	}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/rdbell/go-nostr"
+)
+
+const (
+	// powFilterModeDrop drops incoming posts and comments below the proof-of-work threshold
+	powFilterModeDrop = "drop"
+	// powFilterModeDownrank keeps incoming posts and comments below the threshold but ranks them lower
+	powFilterModeDownrank = "downrank"
+)
+
+// powMiningTimeout is how long publishEvent will spend mining a nonce before giving up
+const powMiningTimeout = 60 * time.Second
+
+// errMiningBusy is returned when every proof-of-work miner is busy, or the user is already mining an event
+var errMiningBusy = errors.New("too many events are being mined right now, please try again shortly")
+
+// powMiners limits how many events are mined at once, one per CPU, and tracks which users are mining
+var powMiners = struct {
+	sync.Mutex
+	slots   chan struct{}
+	pubkeys map[string]bool
+}{
+	slots:   make(chan struct{}, runtime.NumCPU()),
+	pubkeys: make(map[string]bool),
+}
+
+// powVoteWeight is how much a vote counts when it lacks proof-of-work and the filter mode is downrank
+const powVoteWeight = 0.5
+
+// powRankingPenalty is subtracted from the ranking of down-ranked posts
+// one ranking point is worth 10x the votes, or about 12.5 hours of age
+const powRankingPenalty = 1.0
+
+// leadingZeroBits counts the leading zero bits of a hex string as described in NIP-13
+func leadingZeroBits(s string) int {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return 0
+	}
+	return leadingZeroBitsBytes(b)
+}
+
+// leadingZeroBitsBytes counts the leading zero bits of a byte slice
+func leadingZeroBitsBytes(b []byte) int {
+	count := 0
+	for _, octet := range b {
+		if octet == 0 {
+			count += 8
+			continue
+		}
+		count += bits.LeadingZeros8(octet)
+		break
+	}
+
+	return count
+}
+
+// eventDifficulty returns the NIP-13 proof-of-work difficulty of an event
+func eventDifficulty(event *nostr.Event) int {
+	// Hash the event rather than trusting its ID field
+	hash := sha256.Sum256(event.Serialize())
+	difficulty := leadingZeroBitsBytes(hash[:])
+
+	for _, tag := range event.Tags {
+		if len(tag) < 3 {
+			continue
+		}
+		if name, ok := tag[0].(string); !ok || name != "nonce" {
+			continue
+		}
+
+		// Honor the committed target so lucky hashes don't count for more than was attempted
+		target, ok := tag[2].(string)
+		if !ok {
+			continue
+		}
+		if t, err := strconv.Atoi(target); err == nil && t < difficulty {
+			difficulty = t
+		}
+	}
+
+	return difficulty
+}
+
+// mineEvent adds a NIP-13 nonce tag to an unsigned event until its ID has the requested difficulty
+// each user mines one event at a time, and errMiningBusy is returned rather than queueing when all miners are busy
+func mineEvent(event *nostr.Event, difficulty int) error {
+	if difficulty <= 0 {
+		return nil
+	}
+
+	powMiners.Lock()
+	if powMiners.pubkeys[event.PubKey] {
+		powMiners.Unlock()
+		return errMiningBusy
+	}
+	select {
+	case powMiners.slots <- struct{}{}:
+	default:
+		powMiners.Unlock()
+		return errMiningBusy
+	}
+	powMiners.pubkeys[event.PubKey] = true
+	powMiners.Unlock()
+
+	defer func() {
+		powMiners.Lock()
+		delete(powMiners.pubkeys, event.PubKey)
+		<-powMiners.slots
+		powMiners.Unlock()
+	}()
+
+	event.Tags = append(event.Tags, nostr.Tag{"nonce", "0", strconv.Itoa(difficulty)})
+	nonceTag := event.Tags[len(event.Tags)-1]
+
+	deadline := time.Now().Add(powMiningTimeout)
+	for nonce := uint64(0); ; nonce++ {
+		nonceTag[1] = strconv.FormatUint(nonce, 10)
+		hash := sha256.Sum256(event.Serialize())
+		if leadingZeroBitsBytes(hash[:]) >= difficulty {
+			return nil
+		}
+
+		if nonce%10000 == 0 && time.Now().After(deadline) {
+			return errors.New("timed out mining proof-of-work")
+		}
+	}
+}
+
+// powRequired returns the difficulty that the ingest filters require for an event's content
+func powRequired(kind int, content []byte) int {
+	if kind != nostr.KindTextNote {
+		return 0
+	}
+
+	// Peek at the content to tell votes, comments and posts apart
+	var fields struct {
+		Target string `json:"target"`
+		Parent string `json:"parent"`
+	}
+	json.Unmarshal(content, &fields)
+
+	if fields.Target != "" {
+		return appConfig.PoWMinVoteDifficulty
+	}
+	if fields.Parent != "" {
+		return appConfig.PoWMinCommentDifficulty
+	}
+	return appConfig.PoWMinPostDifficulty
+}
+
+// powThreshold returns the minimum difficulty for an incoming post or comment
+func powThreshold(post *schemas.Post) int {
+	if post.Parent != "" {
+		return appConfig.PoWMinCommentDifficulty
+	}
+	return appConfig.PoWMinPostDifficulty
+}
+
+// powAccepted returns false if a post or comment should be dropped at ingest for lacking proof-of-work
+func powAccepted(post *schemas.Post) bool {
+	return post.PoW >= powThreshold(post) || appConfig.PoWFilterMode == powFilterModeDownrank
+}
+
+// powVoteAccepted returns false if a vote should be dropped at ingest for lacking proof-of-work
+func powVoteAccepted(pow int) bool {
+	return pow >= appConfig.PoWMinVoteDifficulty || appConfig.PoWFilterMode == powFilterModeDownrank
+}
+
+// powVoteMultiplier returns how much a vote counts for its proof-of-work. votes lacking it are down-ranked by counting for less
+func powVoteMultiplier(pow int) float64 {
+	if pow < appConfig.PoWMinVoteDifficulty {
+		return powVoteWeight
+	}
+	return 1
+}
+
+// powPenalty returns the ranking penalty for a post that lacks proof-of-work
+func powPenalty(pow int, parent string) float64 {
+	threshold := appConfig.PoWMinPostDifficulty
+	if parent != "" {
+		threshold = appConfig.PoWMinCommentDifficulty
+	}
+
+	if pow < threshold {
+		return powRankingPenalty
+	}
+	return 0
+}
+
+// powAllowsUnverified returns true if unverified users may post by mining proof-of-work
+func powAllowsUnverified() bool {
+	return appConfig.PoWPublishDifficulty > 0
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rdbell/go-nostr"
+)
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want int
+	}{
+		{"ff", 0},
+		{"7f", 1},
+		{"0f", 4},
+		{"00ff", 8},
+		{"0001", 15},
+		{"000000", 24},
+		{"not hex", 0},
+	}
+
+	for _, test := range tests {
+		if got := leadingZeroBits(test.hex); got != test.want {
+			t.Errorf("leadingZeroBits(%q) = %d, want %d", test.hex, got, test.want)
+		}
+	}
+}
+
+func TestEventDifficulty(t *testing.T) {
+	event := &nostr.Event{
+		PubKey:    strings.Repeat("a", 64),
+		CreatedAt: 1700000000,
+		Kind:      nostr.KindTextNote,
+		Content:   "pow test",
+		Tags:      nostr.Tags{},
+	}
+	if err := mineEvent(event, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	// The committed target caps the difficulty, so lucky hashes don't count for more
+	if got := eventDifficulty(event); got != 8 {
+		t.Errorf("eventDifficulty of an event mined to 8 = %d, want 8", got)
+	}
+
+	// A claimed ID doesn't count. the event is hashed
+	event.ID = strings.Repeat("0", 64)
+	if got := eventDifficulty(event); got != 8 {
+		t.Errorf("eventDifficulty with a forged ID = %d, want 8", got)
+	}
+
+	// Changing the content invalidates the work
+	event.Content = "tampered"
+	if got := eventDifficulty(event); got >= 8 {
+		t.Errorf("eventDifficulty of a tampered event = %d, want less than 8", got)
+	}
+
+	// Without a nonce tag the hash alone decides
+	plain := &nostr.Event{PubKey: event.PubKey, CreatedAt: event.CreatedAt, Kind: nostr.KindTextNote, Content: "plain", Tags: nostr.Tags{}}
+	hash := sha256.Sum256(plain.Serialize())
+	if want := leadingZeroBitsBytes(hash[:]); eventDifficulty(plain) != want {
+		t.Errorf("eventDifficulty without a nonce = %d, want %d", eventDifficulty(plain), want)
+	}
+}
+
+func TestMineEventBusy(t *testing.T) {
+	pubkey := strings.Repeat("b", 64)
+
+	// A user already mining an event has to wait for it to finish
+	powMiners.Lock()
+	powMiners.pubkeys[pubkey] = true
+	powMiners.Unlock()
+	err := mineEvent(&nostr.Event{PubKey: pubkey, Tags: nostr.Tags{}}, 1)
+	powMiners.Lock()
+	delete(powMiners.pubkeys, pubkey)
+	powMiners.Unlock()
+	if !errors.Is(err, errMiningBusy) {
+		t.Errorf("mineEvent for a user already mining = %v, want errMiningBusy", err)
+	}
+
+	// Nobody can mine while every slot is taken
+	for i := 0; i < cap(powMiners.slots); i++ {
+		powMiners.slots <- struct{}{}
+	}
+	err = mineEvent(&nostr.Event{PubKey: pubkey, Tags: nostr.Tags{}}, 1)
+	for i := 0; i < cap(powMiners.slots); i++ {
+		<-powMiners.slots
+	}
+	if !errors.Is(err, errMiningBusy) {
+		t.Errorf("mineEvent with every slot taken = %v, want errMiningBusy", err)
+	}
+
+	if err = mineEvent(&nostr.Event{PubKey: pubkey, Tags: nostr.Tags{}}, 1); err != nil {
+		t.Errorf("mineEvent with free slots = %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// reportRoutes sets up report and review queue routes
+func reportRoutes(e *echo.Echo) {
+	e.POST("/report", isLoggedIn(isVerified(reportSubmitHandler)))
+	e.GET("/admin/reports", isLoggedIn(isOperatorUser(reportsHandler)))
+}
+
+const (
+	// reviewQueueLimit caps the number of reported items on the review queue
+	reviewQueueLimit = 100
+	// reviewReportsLimit caps the number of individual reports shown for each reported item
+	reviewReportsLimit = 10
+)
+
+// reportedItem defines a post or user awaiting review, with its reports aggregated
+type reportedItem struct {
+	Event   string            // reported post's ID. empty for reports on a user
+	Target  string            // reported user, or the reported post's author
+	Count   int               // number of reports
+	Types   []string          // distinct report categories
+	Latest  uint32            // when the latest report arrived (see insertReport)
+	Post    *schemas.Post     // reported post, or nil if it isn't in the DB
+	Reports []*schemas.Report // latest individual reports
+}
+
+// hiddenItem defines a post or user hidden on this gateway by an operator
+type hiddenItem struct {
+	Target    string // hidden post's ID or user's pubkey
+	User      bool   // whether the target is a user
+	CreatedAt uint32 // when it was hidden
+}
+
+// reportSubmitHandler publishes a NIP-56 report on a post or user
+func reportSubmitHandler(c echo.Context) error {
+	report := &schemas.Report{}
+	if err := c.Bind(report); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+	report.Comment = strings.TrimSpace(report.Comment)
+
+	// Reports on a post always name its author
+	if report.Event != "" {
+		post, err := getPost(report.Event)
+		if err != nil {
+			return serveError(c, http.StatusNotFound, errors.New("not found"))
+		}
+		report.Target = post.PubKey
+	}
+
+	if !report.IsValid() {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid report"))
+	}
+	if report.Target == c.Get("user").(*schemas.User).PubKey {
+		return serveError(c, http.StatusInternalServerError, errors.New("cannot report yourself"))
+	}
+
+	// Publish report event
+	_, err := publishEvent(c, []byte(report.Comment), schemas.KindReport, report.Tags())
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	// Attempt redirect back to page that the user came from
+	if report.Event != "" {
+		return redirectBack(c, "/p/"+report.Event)
+	}
+	return redirectBack(c, "/u/"+report.Target)
+}
+
+// reportsHandler serves the operators' review queue of reported posts and users
+func reportsHandler(c echo.Context) error {
+	var page struct {
+		Items  []*reportedItem
+		Hidden []*hiddenItem
+	}
+
+	var err error
+	page.Items, err = reviewQueue()
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	page.Hidden, err = gatewayHidden()
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	pd := new(pageData).Init(c)
+	pd.Title = "Reports"
+	pd.Page = page
+	return c.Render(http.StatusOK, "base:reports", pd)
+}
+
+// reviewQueue queries the DB and returns reported posts and users with reports newer than the operators' last decision on them
+func reviewQueue() ([]*reportedItem, error) {
+	rows, err := db.Query(`SELECT event, target, COUNT(*) AS count, GROUP_CONCAT(DISTINCT type), MAX(seen_at) AS latest FROM reports
+		GROUP BY event, target
+		HAVING latest > COALESCE((SELECT MAX(created_at) FROM operator_actions
+			WHERE operator_actions.target = CASE WHEN reports.event != '' THEN reports.event ELSE reports.target END
+			AND action IN ('hide', 'unhide', 'hide_user', 'unhide_user')), 0)
+		ORDER BY count DESC, latest DESC LIMIT ?`, reviewQueueLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*reportedItem
+	for rows.Next() {
+		item := &reportedItem{}
+		var types string
+		err = rows.Scan(&item.Event, &item.Target, &item.Count, &types, &item.Latest)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		item.Types = strings.Split(types, ",")
+		items = append(items, item)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Fill posts and individual reports once the aggregate query is closed
+	for _, item := range items {
+		if item.Event != "" {
+			item.Post, _ = getPost(item.Event)
+		}
+		item.Reports, err = reportsForTarget(item.Event, item.Target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+// reportsForTarget queries the DB and returns the latest reports on a post or user
+func reportsForTarget(event string, target string) ([]*schemas.Report, error) {
+	rows, err := db.Query(`SELECT id, pubkey, type, comment, created_at FROM reports WHERE event = ? AND target = ? ORDER BY created_at DESC LIMIT ?`, event, target, reviewReportsLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []*schemas.Report
+	for rows.Next() {
+		report := &schemas.Report{Event: event, Target: target}
+		err = rows.Scan(&report.ID, &report.PubKey, &report.Type, &report.Comment, &report.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, rows.Err()
+}
+
+// gatewayHidden queries the DB and returns the posts and users hidden on this gateway, most recent first
+func gatewayHidden() ([]*hiddenItem, error) {
+	rows, err := db.Query(`SELECT target, FALSE, created_at FROM gateway_hidden_posts
+		UNION ALL SELECT target, TRUE, created_at FROM gateway_hidden_users
+		ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hidden []*hiddenItem
+	for rows.Next() {
+		item := &hiddenItem{}
+		err = rows.Scan(&item.Target, &item.User, &item.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		hidden = append(hidden, item)
+	}
+
+	return hidden, rows.Err()
+}
+
+// isHiddenUser returns true if the gateway's operators hide a user
+func isHiddenUser(pubkey string) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM gateway_hidden_users WHERE target = ?`, pubkey).Scan(&count)
+	return count > 0
+}
+
+// insertReport stores a report in the DB, replacing the reporter's earlier report on the same post or user
+// reports count from when they arrived, or their own timestamp if that's earlier. the review queue compares that with operators'
+// decisions, so a report dated in the future can't stay ahead of them. those are dropped, since they'd also block the reporter's later reports
+func insertReport(report *schemas.Report) error {
+	now := uint32(time.Now().Unix())
+	if report.CreatedAt > now+maxClockSkew {
+		return errors.New("report is dated in the future")
+	}
+	seenAt := report.CreatedAt
+	if seenAt > now {
+		seenAt = now
+	}
+
+	_, err := db.Exec(`INSERT INTO reports(id, pubkey, event, target, type, comment, created_at, seen_at) VALUES(?,?,?,?,?,?,?,?)
+		ON CONFLICT (pubkey, event, target) DO UPDATE SET id=excluded.id, type=excluded.type, comment=excluded.comment, created_at=excluded.created_at, seen_at=excluded.seen_at
+		WHERE excluded.created_at > reports.created_at`,
+		report.ID, report.PubKey, report.Event, report.Target, report.Type, report.Comment, report.CreatedAt, seenAt)
+	return err
+}
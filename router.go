@@ -13,6 +13,18 @@ func setRoutes(e *echo.Echo) {
 	postRoutes(e)
 	voteRoutes(e)
 	channelRoutes(e)
+	tagRoutes(e)
+	crosspostRoutes(e)
+	linkRoutes(e)
+	nip05Routes(e)
+	muteRoutes(e)
+	followRoutes(e)
+	subscriptionRoutes(e)
+	insightsRoutes(e)
+	moderationRoutes(e)
+	reportRoutes(e)
+	blocklistRoutes(e)
+	adminRoutes(e)
 
 	// Static assets
 	fs := http.FileServer(http.Dir("./assets"))
@@ -0,0 +1,94 @@
+package schemas
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/rdbell/go-nostr"
+)
+
+// KindChannelDefinition is the parameterized replaceable event kind for a channel's definition
+// the "d" tag holds the channel name and the content holds the JSON-encoded Channel
+const KindChannelDefinition = 30100
+
+const (
+	// channelDescriptionMaxCharacters is the maximum allowed length of a channel's description
+	channelDescriptionMaxCharacters = 500
+	// channelRulesMaxCharacters is the maximum allowed length of a channel's rules
+	channelRulesMaxCharacters = 5000
+)
+
+// Channel defines a channel's metadata
+type Channel struct {
+	Name        string   `json:"name" form:"-"`                            // channel name, matching the "d" tag
+	Description string   `json:"description,omitempty" form:"description"` // short description shown in the sidebar
+	Rules       string   `json:"rules,omitempty" form:"rules"`             // markdown rules shown in the sidebar
+	Banner      string   `json:"banner,omitempty" form:"banner"`           // banner image URL
+	NSFW        bool     `json:"nsfw,omitempty" form:"nsfw"`               // whether the channel is not safe for work
+	Flair       []string `json:"flair,omitempty" form:"flair"`             // flair posters can choose from, one per line in the form
+	Creator     string   `json:"-" form:"-"`                               // pubkey that owns the channel, the only pubkey allowed to update it
+	CreatedAt   uint32   `json:"-" form:"-"`                               // timestamp of the channel's first definition
+	UpdatedAt   uint32   `json:"-" form:"-"`                               // timestamp of the channel's latest definition
+}
+
+// ChannelFromEvent returns a *Channel for a supplied nostr event
+func ChannelFromEvent(event *nostr.Event) (*Channel, error) {
+	if event.Kind != KindChannelDefinition {
+		return nil, errors.New("not a channel definition")
+	}
+
+	channel := &Channel{}
+	err := json.Unmarshal([]byte(event.Content), channel)
+	if err != nil {
+		return nil, errors.New("unable to unmarshal channel")
+	}
+
+	// The "d" tag identifies the channel. Content names that don't match are ignored
+	channel.Name = dTag(event.Tags)
+	if channel.Name != SanitizeChannel(channel.Name) {
+		return nil, errors.New("invalid channel name")
+	}
+
+	channel.Creator = event.PubKey
+	channel.CreatedAt = event.CreatedAt
+	channel.UpdatedAt = event.CreatedAt
+	channel.Sanitize()
+
+	if !channel.IsValid() {
+		return nil, errors.New("invalid channel")
+	}
+
+	return channel, nil
+}
+
+// IsValid ensures that a channel looks valid for submission
+func (channel *Channel) IsValid() bool {
+	if channel == nil || channel.Name == "" {
+		return false
+	}
+
+	return len(channel.Name) <= appConfig.ChannelMaxCharacters
+}
+
+// Sanitize trims the channel's fields to prepare for publishing and DB insertion
+func (channel *Channel) Sanitize() {
+	channel.Name = SanitizeChannel(channel.Name)
+	channel.Description = truncateRunes(strings.TrimSpace(channel.Description), channelDescriptionMaxCharacters)
+	channel.Rules = truncateRunes(strings.TrimSpace(channel.Rules), channelRulesMaxCharacters)
+	channel.Banner = sanitizeURL(channel.Banner)
+	channel.Flair = SanitizeChannelFlair(channel.Flair)
+}
+
+// Tags returns the tags for publishing a channel definition event
+func (channel *Channel) Tags() nostr.Tags {
+	return nostr.Tags{nostr.Tag{"d", channel.Name}}
+}
+
+// truncateRunes shortens a string to at most max characters
+func truncateRunes(s string, max int) string {
+	if len([]rune(s)) > max {
+		return string([]rune(s)[0:max])
+	}
+	return s
+}
@@ -0,0 +1,9 @@
+package schemas
+
+// FollowTag is the contact list tag holding a followed pubkey
+const FollowTag = "p"
+
+// IsValidFollow ensures that a followed value looks like a pubkey
+func IsValidFollow(pubkey string) bool {
+	return len(pubkey) == 64
+}
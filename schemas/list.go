@@ -0,0 +1,110 @@
+package schemas
+
+import (
+	"errors"
+
+	"github.com/rdbell/go-nostr"
+)
+
+// List defines a user's replaceable list event, such as a NIP-51 mute list or a kind-3 contact list
+// items are tags with the item's value in the second position, e.g. ["p", <pubkey>] or ["channel", <name>]
+type List struct {
+	Kind      int        // list event kind
+	PubKey    string     // list owner's public key
+	D         string     // "d" tag identifying the list, for parameterized replaceable lists
+	CreatedAt uint32     // creation timestamp
+	Tags      nostr.Tags // every tag on the list, including ones nvote doesn't understand
+	Content   string     // content set by other clients, such as private list items or relays, preserved on republish
+}
+
+// IsParameterizedReplaceable reports whether an event kind is identified by its "d" tag as well as its pubkey
+func IsParameterizedReplaceable(kind int) bool {
+	return kind >= 30000 && kind < 40000
+}
+
+// ListFromEvent returns a *List for a supplied nostr event of the expected list kind
+func ListFromEvent(event *nostr.Event, kind int) (*List, error) {
+	if event.Kind != kind {
+		return nil, errors.New("unexpected list kind")
+	}
+
+	list := &List{
+		Kind:      event.Kind,
+		PubKey:    event.PubKey,
+		CreatedAt: event.CreatedAt,
+		Tags:      event.Tags,
+		Content:   event.Content,
+	}
+	if list.Tags == nil {
+		list.Tags = make(nostr.Tags, 0)
+	}
+
+	if IsParameterizedReplaceable(kind) {
+		list.D = dTag(event.Tags)
+		if list.D == "" {
+			return nil, errors.New("missing d tag")
+		}
+	}
+
+	return list, nil
+}
+
+// Values returns the values listed under a tag
+func (list *List) Values(tag string) []string {
+	var values []string
+	if list == nil {
+		return values
+	}
+
+	for _, t := range list.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		name, ok := t[0].(string)
+		if !ok || name != tag {
+			continue
+		}
+		if value, ok := t[1].(string); ok {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// Contains reports whether a value is listed under a tag
+func (list *List) Contains(tag string, value string) bool {
+	for _, v := range list.Values(tag) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Add lists a value under a tag
+func (list *List) Add(tag string, value string) {
+	if list.Contains(tag, value) {
+		return
+	}
+	if list.D != "" && dTag(list.Tags) == "" {
+		list.Tags = append(nostr.Tags{nostr.Tag{"d", list.D}}, list.Tags...)
+	}
+	list.Tags = append(list.Tags, nostr.Tag{tag, value})
+}
+
+// Remove removes a value listed under a tag
+func (list *List) Remove(tag string, value string) {
+	tags := make(nostr.Tags, 0, len(list.Tags))
+	for _, t := range list.Tags {
+		if len(t) >= 2 {
+			name, _ := t[0].(string)
+			v, _ := t[1].(string)
+			if name == tag && v == value {
+				continue
+			}
+		}
+		tags = append(tags, t)
+	}
+	list.Tags = tags
+}
@@ -0,0 +1,174 @@
+package schemas
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/rdbell/go-nostr"
+)
+
+// KindModeratorList is the parameterized replaceable event kind for a channel's moderator list
+// the "d" tag holds the channel name, with one "p" tag per moderator. only lists published by the channel's creator count
+const KindModeratorList = 30101
+
+// ModeratorTag is the moderator list tag holding an appointed moderator
+const ModeratorTag = "p"
+
+const (
+	// ThreadLocked is the status of a thread locked by its author or a channel moderator
+	ThreadLocked = "locked"
+	// ThreadArchived is the status of a thread older than the configured archive age
+	ThreadArchived = "archived"
+)
+
+// PostModeration defines the moderation state of a post
+type PostModeration struct {
+	Removed        bool   // removed by a channel moderator
+	Reason         string // reason given for the removal
+	Locked         bool   // thread locked by a channel moderator
+	LockedByAuthor bool   // thread locked by its author
+	Archived       bool   // thread older than the configured archive age
+	Pinned         bool   // pinned by a channel moderator
+	Announced      bool   // pinned to the front page by a gateway operator
+}
+
+// Status returns whether the post's thread is locked or archived, or an empty string if it's open
+func (moderation PostModeration) Status() string {
+	if moderation.Locked || moderation.LockedByAuthor {
+		return ThreadLocked
+	}
+	if moderation.Archived {
+		return ThreadArchived
+	}
+	return ""
+}
+
+// KindModerationAction is the event kind for a moderator's action on a post or comment
+// the "e" tag holds the target post, or the "p" tag the target user, and the content holds the JSON-encoded ModerationAction
+const KindModerationAction = 4100
+
+const (
+	// ModerationRemove hides a post from the channel
+	ModerationRemove = "remove"
+	// ModerationApprove restores a removed post
+	ModerationApprove = "approve"
+	// ModerationLock stops new replies in a thread
+	ModerationLock = "lock"
+	// ModerationUnlock reopens a locked thread
+	ModerationUnlock = "unlock"
+	// ModerationPin pins a post to the top of the channel, or of the front page for the gateway operators
+	ModerationPin = "pin"
+	// ModerationUnpin unpins a post
+	ModerationUnpin = "unpin"
+	// ModerationHide hides a post on this gateway. only honoured for the gateway operators
+	ModerationHide = "hide"
+	// ModerationUnhide restores a hidden post, or keeps a reported one
+	ModerationUnhide = "unhide"
+	// ModerationHideUser hides all of a user's posts on this gateway. only honoured for the gateway operators
+	ModerationHideUser = "hide_user"
+	// ModerationUnhideUser restores a hidden user, or keeps a reported one
+	ModerationUnhideUser = "unhide_user"
+)
+
+// moderationReasonMaxCharacters is the maximum allowed length of a moderation action's reason
+const moderationReasonMaxCharacters = 256
+
+// ModerationAction defines a moderator's action on a post or comment
+type ModerationAction struct {
+	ID        string `json:"-" form:"-"`                             // nostr event's ID
+	PubKey    string `json:"-" form:"-"`                             // moderator's public key
+	Target    string `json:"-" form:"-"`                             // target post's nostr event ID from the "e" tag, or target user's pubkey from the "p" tag
+	Action    string `json:"action" form:"action"`                   // remove, approve, lock, unlock, pin or unpin
+	Reason    string `json:"reason,omitempty" form:"reason"`         // optional reason shown to viewers
+	Expires   uint32 `json:"expires,omitempty" form:"-"`             // pin and announcement expiry timestamp. 0 never expires
+	FrontPage bool   `json:"front_page,omitempty" form:"front_page"` // pin to the gateway's front page instead of the channel. only honoured for the gateway operators
+	CreatedAt uint32 `json:"-" form:"-"`                             // creation timestamp
+}
+
+// ModerationActionFromEvent returns a *ModerationAction for a supplied nostr event
+func ModerationActionFromEvent(event *nostr.Event) (*ModerationAction, error) {
+	if event.Kind != KindModerationAction {
+		return nil, errors.New("not a moderation action")
+	}
+
+	action := &ModerationAction{}
+	err := json.Unmarshal([]byte(event.Content), action)
+	if err != nil {
+		return nil, errors.New("unable to unmarshal moderation action")
+	}
+
+	action.ID = event.ID
+	action.PubKey = event.PubKey
+	action.CreatedAt = event.CreatedAt
+	targetTag := "e"
+	if action.TargetsUser() {
+		targetTag = "p"
+	}
+	for _, t := range event.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		if name, _ := t[0].(string); name == targetTag {
+			action.Target, _ = t[1].(string)
+			break
+		}
+	}
+
+	action.Reason = truncateRunes(action.Reason, moderationReasonMaxCharacters)
+	if !action.IsValid() {
+		return nil, errors.New("invalid moderation action")
+	}
+
+	return action, nil
+}
+
+// IsValid ensures that a moderation action looks valid for submission
+func (action *ModerationAction) IsValid() bool {
+	if action == nil || len(action.Target) != 64 {
+		return false
+	}
+
+	switch action.Action {
+	case ModerationPin, ModerationUnpin:
+		return true
+	case ModerationRemove, ModerationApprove, ModerationLock, ModerationUnlock, ModerationHide, ModerationUnhide, ModerationHideUser, ModerationUnhideUser:
+		return !action.FrontPage && action.Expires == 0
+	}
+	return false
+}
+
+// IsGatewayAction reports whether an action applies to this whole gateway, so only the gateway operators may take it
+func (action *ModerationAction) IsGatewayAction() bool {
+	switch action.Action {
+	case ModerationHide, ModerationUnhide, ModerationHideUser, ModerationUnhideUser:
+		return true
+	}
+	return action.FrontPage
+}
+
+// TargetsUser reports whether an action's target is a user's pubkey rather than a post
+func (action *ModerationAction) TargetsUser() bool {
+	return action.Action == ModerationHideUser || action.Action == ModerationUnhideUser
+}
+
+// Tags returns the tags identifying a moderation action's target
+func (action *ModerationAction) Tags() nostr.Tags {
+	if action.TargetsUser() {
+		return nostr.Tags{nostr.Tag{"p", action.Target}}
+	}
+	return nostr.Tags{nostr.Tag{"e", action.Target}}
+}
+
+// dTag returns the value of an event's "d" tag, which identifies parameterized replaceable events
+func dTag(tags nostr.Tags) string {
+	for _, t := range tags {
+		if len(t) < 2 {
+			continue
+		}
+		if name, _ := t[0].(string); name == "d" {
+			value, _ := t[1].(string)
+			return value
+		}
+	}
+	return ""
+}
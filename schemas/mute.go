@@ -0,0 +1,49 @@
+package schemas
+
+import (
+	"strings"
+)
+
+// KindMuteList is the NIP-51 mute list event kind
+const KindMuteList = 10000
+
+const (
+	// MuteTagPubKey mutes a user
+	MuteTagPubKey = "p"
+	// MuteTagThread mutes a post and all of its comments
+	MuteTagThread = "e"
+	// MuteTagWord mutes posts containing a keyword
+	MuteTagWord = "word"
+	// MuteTagChannel mutes a channel
+	MuteTagChannel = "channel"
+)
+
+// IsValidMuteTag ensures that a mute tag/value pair is something nvote can apply
+func IsValidMuteTag(tag string, value string) bool {
+	if value == "" || len(value) > 256 {
+		return false
+	}
+
+	switch tag {
+	case MuteTagPubKey, MuteTagThread:
+		return len(value) == 64
+	case MuteTagWord, MuteTagChannel:
+		return true
+	}
+
+	return false
+}
+
+// SanitizeMuteValue normalizes a mute value the same way the matching post field is normalized
+func SanitizeMuteValue(tag string, value string) string {
+	value = strings.TrimSpace(value)
+
+	switch tag {
+	case MuteTagPubKey, MuteTagThread, MuteTagWord:
+		return strings.ToLower(value)
+	case MuteTagChannel:
+		return SanitizeChannel(value)
+	}
+
+	return value
+}
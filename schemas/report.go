@@ -0,0 +1,108 @@
+package schemas
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/rdbell/go-nostr"
+)
+
+// KindReport is the NIP-56 event kind for reporting a post or a user
+const KindReport = 1984
+
+// ReportTypes lists the NIP-56 report categories, in the order they're offered to users
+var ReportTypes = []string{"spam", "illegal", "impersonation", "nudity", "profanity", "malware", "other"}
+
+// reportCommentMaxCharacters is the maximum allowed length of a report's comment
+const reportCommentMaxCharacters = 500
+
+// Report defines a NIP-56 report
+type Report struct {
+	ID        string `form:"-"`       // nostr event's ID
+	PubKey    string `form:"-"`       // reporter's public key
+	Event     string `form:"event"`   // reported post's nostr event ID. empty for reports on a user
+	Target    string `form:"pubkey"`  // reported user's public key, or the reported post's author
+	Type      string `form:"type"`    // report category, one of ReportTypes
+	Comment   string `form:"comment"` // optional comment from the reporter
+	CreatedAt uint32 `form:"-"`       // creation timestamp
+}
+
+// ReportFromEvent returns a *Report for a supplied nostr event
+// the report type is read from the "e" tag when a post is reported, and from the "p" tag otherwise
+func ReportFromEvent(event *nostr.Event) (*Report, error) {
+	if event.Kind != KindReport {
+		return nil, errors.New("not a report")
+	}
+
+	report := &Report{
+		ID:        event.ID,
+		PubKey:    event.PubKey,
+		Comment:   truncateRunes(event.Content, reportCommentMaxCharacters),
+		CreatedAt: event.CreatedAt,
+	}
+
+	for _, t := range event.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		name, _ := t[0].(string)
+		value, _ := t[1].(string)
+		reportType := ""
+		if len(t) >= 3 {
+			reportType, _ = t[2].(string)
+		}
+
+		switch {
+		case name == "e" && report.Event == "":
+			report.Event = value
+			if reportType != "" {
+				report.Type = reportType
+			}
+		case name == "p" && report.Target == "":
+			report.Target = value
+			if reportType != "" && report.Type == "" {
+				report.Type = reportType
+			}
+		}
+	}
+
+	// Reports without a recognised category still count, as "other"
+	report.Type = strings.ToLower(report.Type)
+	if !IsValidReportType(report.Type) {
+		report.Type = "other"
+	}
+	if !report.IsValid() {
+		return nil, errors.New("invalid report")
+	}
+
+	return report, nil
+}
+
+// IsValidReportType ensures that a report category is one of ReportTypes
+func IsValidReportType(reportType string) bool {
+	for _, t := range ReportTypes {
+		if t == reportType {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid ensures that a report looks valid for submission
+func (report *Report) IsValid() bool {
+	if report == nil || len(report.Target) != 64 {
+		return false
+	}
+	if report.Event != "" && len(report.Event) != 64 {
+		return false
+	}
+	return IsValidReportType(report.Type) && len([]rune(report.Comment)) <= reportCommentMaxCharacters
+}
+
+// Tags returns the NIP-56 tags for a report
+func (report *Report) Tags() nostr.Tags {
+	if report.Event != "" {
+		return nostr.Tags{nostr.Tag{"e", report.Event, report.Type}, nostr.Tag{"p", report.Target}}
+	}
+	return nostr.Tags{nostr.Tag{"p", report.Target, report.Type}}
+}
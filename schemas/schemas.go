@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"html"
+	"net/url"
 	"regexp"
 	"strings"
 
@@ -22,15 +23,27 @@ func InitConfig(a *AppConfig) {
 
 // Post defines a post structure
 type Post struct {
-	ID        string `json:"id,omitempty" form:"id"`                 // nostr event's ID
-	Score     int32  `json:"score,omitempty" form:"score"`           // post's score
-	Children  int32  `json:"children,omitempty" form:"children"`     // number of children
-	PubKey    string `json:"pubkey,omitempty" form:"pubkey"`         // poster's public key
-	CreatedAt uint32 `json:"created_at,omitempty" form:"created_at"` // creation timestamp
-	Title     string `json:"title,omitempty" form:"title"`           // post's title
-	Body      string `json:"body,omitempty" form:"body"`             // post's body
-	Channel   string `json:"channel,omitempty" form:"channel"`       // post's channel
-	Parent    string `json:"parent,omitempty" form:"parent"`         // parent post's nostr event ID
+	ID            string         `json:"id,omitempty" form:"id"`                 // nostr event's ID
+	Score         int32          `json:"score,omitempty" form:"score"`           // post's score
+	WeightedScore float64        `json:"-" form:"-"`                             // post's score with each vote weighted by its voter's standing
+	Children      int32          `json:"children,omitempty" form:"children"`     // number of children
+	PubKey        string         `json:"pubkey,omitempty" form:"pubkey"`         // poster's public key
+	CreatedAt     uint32         `json:"created_at,omitempty" form:"created_at"` // creation timestamp
+	Title         string         `json:"title,omitempty" form:"title"`           // post's title
+	Body          string         `json:"body,omitempty" form:"body"`             // post's body
+	Channel       string         `json:"channel,omitempty" form:"channel"`       // post's channel
+	Parent        string         `json:"parent,omitempty" form:"parent"`         // parent post's nostr event ID
+	Flair         string         `json:"flair,omitempty" form:"flair"`           // flair chosen from the channel's flair. only kept when the channel defines it
+	Hashtags      []string       `json:"-" form:"tags"`                          // NIP-12 hashtags from the event's "t" tags
+	Crosspost     string         `json:"crosspost,omitempty" form:"crosspost"`   // original post's nostr event ID, for a crosspost to another channel
+	PoW           int            `json:"-" form:"-"`                             // NIP-13 proof-of-work difficulty of the post's event
+	PostedAt      uint32         `json:"-" form:"-"`                             // when the post counts as posted for thread locks and archiving. its timestamp unless it arrived backdated
+	Labels        []string       `json:"-" form:"-"`                             // labels added by the content filters
+	Collapsed     bool           `json:"-" form:"-"`                             // whether the content filters collapse this post
+	Pinned        bool           `json:"-" form:"-"`                             // whether the post is pinned to the top of its channel or the front page
+	PinnedUntil   uint32         `json:"-" form:"-"`                             // when the pin expires. 0 never expires
+	Moderation    PostModeration `json:"-" form:"-"`                             // moderation state of the post and its thread
+	CanModerate   bool           `json:"-" form:"-"`                             // whether the viewer moderates the post's channel
 }
 
 // IsValidPost ensures that a post looks valid for submission
@@ -65,10 +78,11 @@ func PostFromEvent(event *nostr.Event) (*Post, error) {
 		return nil, errors.New("unable to unmarshal post")
 	}
 
-	// Pull event ID, ts and pubkey from event
+	// Pull event ID, ts, pubkey and hashtags from event
 	post.ID = event.ID
 	post.CreatedAt = event.CreatedAt
 	post.PubKey = event.PubKey
+	post.Hashtags = HashtagsFromTags(event.Tags)
 
 	// Validate
 	if !post.IsValidPost() && !post.IsValidComment() {
@@ -92,6 +106,8 @@ func (post *Post) PrepareForPublish() {
 	if post.IsValidComment() {
 		post.Title = ""
 		post.Channel = ""
+		post.Flair = ""
+		post.Crosspost = ""
 	}
 
 	// Format top-level posts
@@ -107,18 +123,13 @@ func (post *Post) PrepareForPublish() {
 
 // Sanitize sanitizes the posts fields to prepare for publishing and DB insertion
 func (post *Post) Sanitize() {
-	// "all" is a special catch-all channel. Don't need to include the param
-	if post.Channel == "all" {
-		post.Channel = ""
+	post.Channel = SanitizeChannel(post.Channel)
+	post.Flair = SanitizeFlair(post.Flair)
+	post.Hashtags = SanitizeHashtags(post.Hashtags)
+	if len(post.Crosspost) != 64 {
+		post.Crosspost = ""
 	}
 
-	// Only allow alphanumeric, underscore, dash in channel name
-	reg, err := regexp.Compile("[^a-zA-Z0-9-_]+")
-	if err != nil {
-		post.Channel = ""
-	}
-	post.Channel = strings.ToLower(reg.ReplaceAllString(post.Channel, ""))
-
 	// Unescape HTML in title and body
 	post.Title = html.UnescapeString(post.Title)
 	post.Body = html.UnescapeString(post.Body)
@@ -142,6 +153,30 @@ func (post *Post) Sanitize() {
 	return
 }
 
+// Tags returns the NIP-12 "t" tags for publishing a post's hashtags
+func (post *Post) Tags() nostr.Tags {
+	tags := make(nostr.Tags, 0, len(post.Hashtags))
+	for _, tag := range post.Hashtags {
+		tags = append(tags, nostr.Tag{"t", tag})
+	}
+	return tags
+}
+
+// SanitizeChannel normalizes a channel name for publishing and DB insertion
+func SanitizeChannel(channel string) string {
+	// "all" is a special catch-all channel. Don't need to include the param
+	if channel == "all" {
+		return ""
+	}
+
+	// Only allow alphanumeric, underscore, dash in channel name
+	reg, err := regexp.Compile("[^a-zA-Z0-9-_]+")
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(reg.ReplaceAllString(channel, ""))
+}
+
 const (
 	// PostTypeAll specifies a request for all post types in a PostFilterset
 	PostTypeAll = iota
@@ -153,14 +188,29 @@ const (
 
 // PostFilterset defines a set of filters for querying posts
 type PostFilterset struct {
-	Channel       string // filter by channel
-	PubKey        string // filter by submitter's pubkey
-	PostContains  string // search within post body/title
-	PostType      int    // filter by post/comment/all (see iota above)
-	HideBadUsers  bool   // hide users with low up/down ratios
-	Page          int    // show only posts after specified offset
-	OrderByColumn string // which column to use for sorting
-	Limit         int    // limit # of rows returned
+	Channel          string // filter by channel
+	PubKey           string // filter by submitter's pubkey
+	PostContains     string // search within post body/title
+	PostType         int    // filter by post/comment/all (see iota above)
+	HideBadUsers     bool   // hide users with low up/down ratios
+	MinAuthorScore   int    // with HideBadUsers, hide authors scoring below this
+	HideDownvoted    bool   // hide downvoted posts and comments
+	MinPostScore     int    // with HideDownvoted, hide posts and comments scoring below this
+	NewAccountCutoff uint32 // hide authors first seen after this timestamp. 0 disables
+	MutedBy          string // hide posts muted by this pubkey's mute list
+	FollowedBy       string // show only posts by pubkeys this pubkey follows
+	SubscribedBy     string // show only posts in channels this pubkey subscribes to
+	TrustedBy        string // show only posts inside this pubkey's web of trust, ranked by trusted votes
+	Unmoderated      bool   // include posts removed by channel moderators, and replies to locked threads
+	Pinned           bool   // show only posts pinned by channel moderators
+	Announced        bool   // show only posts pinned to the front page by the gateway operators
+	ModeratedBy      string // mark posts in channels this pubkey moderates (see Post.CanModerate)
+	Hashtag          string // show only posts with this hashtag
+	Flair            string // show only posts with this flair from their channel
+	Domain           string // show only link posts to this domain or its subdomains, not including crossposts
+	Page             int    // show only posts after specified offset
+	OrderByColumn    string // which column to use for sorting
+	Limit            int    // limit # of rows returned
 	// TODO: sort direction?
 }
 
@@ -171,6 +221,7 @@ type Vote struct {
 	Channel   string `json:"channel,omitempty" form:"channel"`      // the target vote's channel
 	CreatedAt uint32 `json:"create_at,omitempty" form:"created_at"` // vote timestamp
 	Direction bool   `json:"direction,omitempty" form:"direction"`  // false=down, true=up
+	PoW       int    `json:"-" form:"-"`                            // NIP-13 proof-of-work difficulty of the vote's event
 }
 
 // PrepareForPublish strips superflous parameters to prepare for publishing (omitempty)
@@ -223,14 +274,26 @@ type VoteFilterset struct {
 
 // User defines a user
 type User struct {
-	PrivKey       string `json:"privkey,omitempty" form:"privkey"`               // user private key
-	PubKey        string `json:"pubkey,omitempty" form:"pubkey"`                 // user public key
-	Name          string `json:"name,omitempty" form:"name"`                     // username
-	About         string `json:"about,omitempty" form:"about"`                   // user bio
-	HideDownvoted bool   `json:"hide_downvoted,omitempty" form:"hide_downvoted"` // hide downvoted comments
-	HideBadUsers  bool   `json:"hide_bad_users,omitempty" form:"hide_bad_users"` // hide users with low up/down ratios
-	HideImages    bool   `json:"hide_images,omitempty" form:"hide_images"`       // don't auto-load images in posts
-	DarkMode      bool   `json:"dark_mode,omitempty" form:"dark_mode"`           // enable dark mode styling
+	PrivKey           string `json:"privkey,omitempty" form:"privkey"`                     // user private key
+	PubKey            string `json:"pubkey,omitempty" form:"pubkey"`                       // user public key
+	Name              string `json:"name,omitempty" form:"name"`                           // username
+	About             string `json:"about,omitempty" form:"about"`                         // user bio
+	DisplayName       string `json:"display_name,omitempty" form:"display_name"`           // display name
+	Picture           string `json:"picture,omitempty" form:"picture"`                     // avatar URL
+	Banner            string `json:"banner,omitempty" form:"banner"`                       // profile banner URL
+	Website           string `json:"website,omitempty" form:"website"`                     // website URL
+	Lud16             string `json:"lud16,omitempty" form:"lud16"`                         // lightning address
+	NIP05             string `json:"nip05,omitempty" form:"nip05"`                         // NIP-05 internet identifier
+	HideDownvoted     bool   `json:"hide_downvoted,omitempty" form:"hide_downvoted"`       // hide downvoted comments
+	HideBadUsers      bool   `json:"hide_bad_users,omitempty" form:"hide_bad_users"`       // hide users with low up/down ratios
+	MinAuthorScore    int    `json:"min_author_score" form:"min_author_score"`             // with HideBadUsers, hide authors scoring below this
+	MinPostScore      int    `json:"min_post_score" form:"min_post_score"`                 // with HideDownvoted, hide posts and collapse comments scoring below this
+	HideNewAccounts   bool   `json:"hide_new_accounts,omitempty" form:"hide_new_accounts"` // hide authors first seen less than MinAccountAgeDays ago
+	MinAccountAgeDays int    `json:"min_account_age_days" form:"min_account_age_days"`     // with HideNewAccounts, minimum author account age
+	WebOfTrust        bool   `json:"web_of_trust,omitempty" form:"web_of_trust"`           // filter and rank by the user's follow graph instead of global scores
+	ShowUnmoderated   bool   `json:"show_unmoderated,omitempty" form:"show_unmoderated"`   // ignore channel moderators' removals and thread locks
+	HideImages        bool   `json:"hide_images,omitempty" form:"hide_images"`             // don't auto-load images in posts
+	DarkMode          bool   `json:"dark_mode,omitempty" form:"dark_mode"`                 // enable dark mode styling
 }
 
 // LoggedOutUser creates a new user object with default values
@@ -240,9 +303,28 @@ func LoggedOutUser() *User {
 		HideBadUsers:  true, // hide low ratio users by default
 		DarkMode:      true, // use dark mode by default
 	}
+	user.SetDefaultThresholds()
 	return user
 }
 
+// SetDefaultThresholds sets the default spam filter thresholds
+// call before decoding a saved user so that settings saved before the thresholds existed keep the old behaviour
+func (user *User) SetDefaultThresholds() {
+	user.MinAuthorScore = -19
+	user.MinPostScore = -5
+	user.MinAccountAgeDays = 7
+}
+
+// SanitizeThresholds clamps spam filter thresholds to sane ranges
+func (user *User) SanitizeThresholds() {
+	if user.MinAccountAgeDays < 0 {
+		user.MinAccountAgeDays = 0
+	}
+	if user.MinAccountAgeDays > 3650 {
+		user.MinAccountAgeDays = 3650
+	}
+}
+
 // Login defines a login
 type Login struct {
 	Password string `json:"password" form:"password"` // allows user to login with a password
@@ -289,13 +371,27 @@ func (login Login) GeneratePrivateKey() (string, error) {
 
 // Metadata defines a user's metadata
 type Metadata struct {
-	Name      string `json:"name" form:"name"`                       // user's username
-	About     string `json:"about" form:"about"`                     // user's bio
-	PubKey    string `json:"pubkey,omitempty" form:"pubkey"`         // user's public key
-	UserScore int    `json:"user_score,omitempty" form:"user_score"` // user's global post/comment score
-	CreatedAt uint32 `json:"created_at,omitempty" form:"created_at"` // creation timestamp
+	Name        string                     `json:"name" form:"name"`                           // user's username
+	DisplayName string                     `json:"display_name,omitempty" form:"display_name"` // user's display name
+	About       string                     `json:"about" form:"about"`                         // user's bio
+	Picture     string                     `json:"picture,omitempty" form:"picture"`           // user's avatar URL
+	Banner      string                     `json:"banner,omitempty" form:"banner"`             // user's profile banner URL
+	Website     string                     `json:"website,omitempty" form:"website"`           // user's website URL
+	Lud16       string                     `json:"lud16,omitempty" form:"lud16"`               // user's lightning address
+	NIP05       string                     `json:"nip05,omitempty" form:"nip05"`               // user's NIP-05 internet identifier
+	PubKey      string                     `json:"pubkey,omitempty" form:"pubkey"`             // user's public key
+	UserScore   int                        `json:"user_score,omitempty" form:"user_score"`     // user's global post/comment score
+	CreatedAt   uint32                     `json:"created_at,omitempty" form:"created_at"`     // creation timestamp
+	Extra       map[string]json.RawMessage `json:"-" form:"-"`                                 // fields set by other clients, preserved on republish
+	Raw         string                     `json:"-" form:"-"`                                 // event content exactly as it was published
 }
 
+// metadataKnownFields lists the metadata fields that nvote reads
+var metadataKnownFields = []string{"name", "display_name", "about", "picture", "banner", "website", "lud16", "nip05", "pubkey", "user_score", "created_at"}
+
+// metadataURLMaxCharacters is the maximum allowed length of a URL in a user's metadata
+const metadataURLMaxCharacters = 512
+
 // IsValid ensures that user metadata looks valid for submission
 func (metadata *Metadata) IsValid() bool {
 	if metadata == nil {
@@ -315,6 +411,22 @@ func (metadata *Metadata) IsValid() bool {
 	return true
 }
 
+// ProfileEquals reports whether two metadata objects have the same user-editable fields
+func (metadata *Metadata) ProfileEquals(other *Metadata) bool {
+	if metadata == nil || other == nil {
+		return metadata == other
+	}
+
+	return metadata.Name == other.Name &&
+		metadata.DisplayName == other.DisplayName &&
+		metadata.About == other.About &&
+		metadata.Picture == other.Picture &&
+		metadata.Banner == other.Banner &&
+		metadata.Website == other.Website &&
+		metadata.Lud16 == other.Lud16 &&
+		metadata.NIP05 == other.NIP05
+}
+
 // PrepareForPublish strips superflous parameters to prepare for publishing (omitempty)
 // this is mainly to reduce nostr event content size
 // clients shouldn't assume all post events received from relays have superflous parameters stripped
@@ -334,6 +446,122 @@ func (metadata *Metadata) Sanitize() {
 		metadata.Name = ""
 	}
 	metadata.Name = reg.ReplaceAllString(metadata.Name, "")
+
+	// Drop malformed NIP-05 identifiers
+	metadata.NIP05 = strings.ToLower(strings.TrimSpace(metadata.NIP05))
+	if _, _, err := ParseNIP05(metadata.NIP05); err != nil {
+		metadata.NIP05 = ""
+	}
+
+	// Drop malformed lightning addresses. lud16 shares the NIP-05 identifier format
+	metadata.Lud16 = strings.ToLower(strings.TrimSpace(metadata.Lud16))
+	if _, _, err := ParseNIP05(metadata.Lud16); err != nil {
+		metadata.Lud16 = ""
+	}
+
+	// Drop non-HTTP links
+	metadata.Picture = sanitizeURL(metadata.Picture)
+	metadata.Banner = sanitizeURL(metadata.Banner)
+	metadata.Website = sanitizeURL(metadata.Website)
+
+	// Enforce display name limit
+	metadata.DisplayName = strings.TrimSpace(metadata.DisplayName)
+	if len([]rune(metadata.DisplayName)) > appConfig.DisplayNameMaxCharacters {
+		metadata.DisplayName = string([]rune(metadata.DisplayName)[0:appConfig.DisplayNameMaxCharacters])
+	}
+}
+
+// sanitizeURL returns a trimmed http(s) URL, or an empty string if s isn't one
+func sanitizeURL(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || len(s) > metadataURLMaxCharacters {
+		return ""
+	}
+
+	u, err := url.ParseRequestURI(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+
+	return u.String()
+}
+
+// Content serializes metadata for a kind-0 event, keeping fields set by other clients
+func (metadata *Metadata) Content() ([]byte, error) {
+	known, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make(map[string]json.RawMessage)
+	for key, value := range metadata.Extra {
+		content[key] = value
+	}
+	err = json.Unmarshal(known, &content)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(content)
+}
+
+// ContentWithNIP05 serializes the metadata's published event content with only the NIP-05 identifier replaced
+// the rest of the content is republished exactly as the user published it, without nvote's sanitization
+func (metadata *Metadata) ContentWithNIP05(nip05 string) ([]byte, error) {
+	content := make(map[string]json.RawMessage)
+	if metadata.Raw != "" {
+		if err := json.Unmarshal([]byte(metadata.Raw), &content); err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := json.Marshal(nip05)
+	if err != nil {
+		return nil, err
+	}
+	if nip05 == "" {
+		delete(content, "nip05")
+	} else {
+		content["nip05"] = value
+	}
+
+	return json.Marshal(content)
+}
+
+// nip05Regexp matches a NIP-05 internet identifier (local-part@domain)
+// domains end in an alphabetic top-level domain, so IP addresses never match. localhost and ports are only allowed for the gateway's own domain (see ParseNIP05)
+var nip05Regexp = regexp.MustCompile(`^([a-z0-9-_.]+)@([a-z0-9-.]+\.[a-z]{2,}|localhost)(:[0-9]+)?$`)
+
+// ParseNIP05 splits a NIP-05 internet identifier into its local-part and domain
+func ParseNIP05(identifier string) (string, string, error) {
+	if identifier == "" || len(identifier) > 256 {
+		return "", "", errors.New("invalid nip05 identifier")
+	}
+
+	matches := nip05Regexp.FindStringSubmatch(strings.ToLower(identifier))
+	if matches == nil {
+		return "", "", errors.New("invalid nip05 identifier")
+	}
+
+	// Remote identifiers are resolved by the server, so they can't point it at local services
+	domain := matches[2] + matches[3]
+	if (matches[2] == "localhost" || matches[3] != "") && domain != SiteHost() {
+		return "", "", errors.New("invalid nip05 domain")
+	}
+
+	return matches[1], domain, nil
+}
+
+// SiteHost returns the host portion of the configured site URL, including any port
+func SiteHost() string {
+	if appConfig == nil {
+		return ""
+	}
+	u, err := url.Parse(appConfig.SiteURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
 }
 
 // MetadataFromEvent returns a *Metadatas for a supplied nostr event
@@ -345,7 +573,17 @@ func MetadataFromEvent(event *nostr.Event) (*Metadata, error) {
 		return nil, errors.New("unable to unmarshal metadata")
 	}
 
-	// Pull ts and pubkey from event
+	// Keep fields set by other clients
+	extra := make(map[string]json.RawMessage)
+	if json.Unmarshal([]byte(event.Content), &extra) == nil {
+		for _, key := range metadataKnownFields {
+			delete(extra, key)
+		}
+		metadata.Extra = extra
+	}
+
+	// Pull ts, pubkey and the unsanitized content from event
+	metadata.Raw = event.Content
 	metadata.PubKey = event.PubKey
 	metadata.CreatedAt = event.CreatedAt
 
@@ -359,23 +597,67 @@ func MetadataFromEvent(event *nostr.Event) (*Metadata, error) {
 
 // AppConfig defines the schema for global app config
 type AppConfig struct {
-	Environment          string   `json:"environment"`             // environment
-	SiteName             string   `json:"site_name"`               // website's name
-	SiteIcon             string   `json:"site_icon"`               // website's icon displayed in the header
-	Tagline              string   `json:"tagline"`                 // website's tagline
-	SiteURL              string   `json:"site_url"`                // webiste's base URL including protocol. no trailing slash
-	ListenPort           int      `json:"listen_port"`             // port to listen on
-	Relays               []string `json:"relays"`                  // nostr relay endpoints
-	RelayPublic          string   `json:"relay_public"`            // publicly accessable relay endpoint
-	RepoLink             string   `json:"repo_link"`               // public repo for the project
-	TelegramLink         string   `json:"telegram_link"`           // public telegram group link
-	PubkeyVerifyURL      string   `json:"pubkey_verify_url"`       // URL for verifying a user's pubkey with the nostr relay
-	VerifyBaseURL        string   `json:"verify_base_url"`         // base URL for a user to submit verification for account
-	CheckVerifiedBaseURL string   `json:"check_verified_base_url"` // base URL for checking if a user is registered with the nostr relay
-	PostsPerPage         int      `json:"posts_per_page"`          // maximum number of posts to display per-page
-	TitleMaxCharacters   int      `json:"title_max_characters"`    // maximum allowed characters in a post title
-	BodyMaxCharacters    int      `json:"body_max_characters"`     // maximum allowed characters in a post/comment body
-	ChannelMaxCharacters int      `json:"channel_max_characters"`  // maximum allowed characters in a channel name
-	NameMaxCharacters    int      `json:"name_max_characters"`     // maximum allowed characters in a user's username
-	BioMaxCharacters     int      `json:"bio_max_characters"`      // maximum allowed characters in a user's bio
+	Environment                      string                 `json:"environment"`                         // environment
+	SiteName                         string                 `json:"site_name"`                           // website's name
+	SiteIcon                         string                 `json:"site_icon"`                           // website's icon displayed in the header
+	Tagline                          string                 `json:"tagline"`                             // website's tagline
+	SiteURL                          string                 `json:"site_url"`                            // webiste's base URL including protocol. no trailing slash
+	ListenPort                       int                    `json:"listen_port"`                         // port to listen on
+	Relays                           []string               `json:"relays"`                              // nostr relay endpoints
+	RelayPublic                      string                 `json:"relay_public"`                        // publicly accessable relay endpoint
+	RepoLink                         string                 `json:"repo_link"`                           // public repo for the project
+	TelegramLink                     string                 `json:"telegram_link"`                       // public telegram group link
+	PubkeyVerifyURL                  string                 `json:"pubkey_verify_url"`                   // URL for verifying a user's pubkey with the nostr relay
+	VerifyBaseURL                    string                 `json:"verify_base_url"`                     // base URL for a user to submit verification for account
+	CheckVerifiedBaseURL             string                 `json:"check_verified_base_url"`             // base URL for checking if a user is registered with the nostr relay
+	VerificationBackend              string                 `json:"verification_backend"`                // account verification backend: relay, allowlist, nip05, pow or none
+	VerificationAllowlistFile        string                 `json:"verification_allowlist_file"`         // file of verified pubkeys for the allowlist backend, one per line
+	VerificationNIP05Domains         []string               `json:"verification_nip05_domains"`          // accepted NIP-05 domains for the nip05 backend
+	VerificationPoWDifficulty        int                    `json:"verification_pow_difficulty"`         // minimum leading zero bits in a pubkey for the pow backend
+	VerificationCacheSeconds         int                    `json:"verification_cache_seconds"`          // how long positive verification results are cached
+	VerificationNegativeCacheSeconds int                    `json:"verification_negative_cache_seconds"` // how long negative verification results are cached
+	PoWPublishDifficulty             int                    `json:"pow_publish_difficulty"`              // leading zero bits mined into events from unverified users. 0 requires verification to post
+	PoWMinPostDifficulty             int                    `json:"pow_min_post_difficulty"`             // minimum proof-of-work for incoming posts
+	PoWMinCommentDifficulty          int                    `json:"pow_min_comment_difficulty"`          // minimum proof-of-work for incoming comments
+	PoWMinVoteDifficulty             int                    `json:"pow_min_vote_difficulty"`             // minimum proof-of-work for incoming votes
+	PoWFilterMode                    string                 `json:"pow_filter_mode"`                     // "drop" or "downrank" posts, comments and votes below the minimum. down-ranked votes count for half
+	PostsPerPage                     int                    `json:"posts_per_page"`                      // maximum number of posts to display per-page
+	TitleMaxCharacters               int                    `json:"title_max_characters"`                // maximum allowed characters in a post title
+	BodyMaxCharacters                int                    `json:"body_max_characters"`                 // maximum allowed characters in a post/comment body
+	ChannelMaxCharacters             int                    `json:"channel_max_characters"`              // maximum allowed characters in a channel name
+	NameMaxCharacters                int                    `json:"name_max_characters"`                 // maximum allowed characters in a user's username
+	BioMaxCharacters                 int                    `json:"bio_max_characters"`                  // maximum allowed characters in a user's bio
+	DisplayNameMaxCharacters         int                    `json:"display_name_max_characters"`         // maximum allowed characters in a user's display name
+	NIP05RecheckMinutes              int                    `json:"nip05_recheck_minutes"`               // how often verified NIP-05 identifiers are re-checked
+	WoTMaxHops                       int                    `json:"wot_max_hops"`                        // how many follow hops from the viewer are trusted
+	WoTDecay                         float64                `json:"wot_decay"`                           // trust multiplier applied for each hop beyond direct follows
+	WoTMaxSize                       int                    `json:"wot_max_size"`                        // maximum number of pubkeys in a viewer's trust set
+	WoTRefreshMinutes                int                    `json:"wot_refresh_minutes"`                 // how often trust sets in use are rebuilt
+	InsightsRefreshMinutes           int                    `json:"insights_refresh_minutes"`            // how often the vote manipulation analysis is re-run
+	VoteWeighting                    bool                   `json:"vote_weighting"`                      // weight votes by voter account age, score and verification, and rank by the weighted score
+	VoteWeightFullAgeDays            int                    `json:"vote_weight_full_age_days"`           // voter account age at which votes carry full weight. 0 ignores account age
+	VoteWeightScoreScale             int                    `json:"vote_weight_score_scale"`             // voter score that doubles a vote's weight, or its negative that zeroes it. 0 ignores voter score
+	VoteWeightUnverified             float64                `json:"vote_weight_unverified"`              // weight multiplier for votes from unverified pubkeys. 0 or 1 ignores verification
+	VoteWeightMin                    float64                `json:"vote_weight_min"`                     // minimum weight of any vote
+	ContentFilters                   []*ContentFilterConfig `json:"content_filters"`                     // server-side content filters, run in order
+	Operators                        []string               `json:"operators"`                           // gateway operators' hex pubkeys. operators can pin posts to the front page
+	BlocklistFile                    string                 `json:"blocklist_file"`                      // file of blocked event IDs, pubkeys, channels and domains, edited from the blocklist page. empty keeps edits in memory
+	FirstSeenFile                    string                 `json:"first_seen_file"`                     // file recording when the gateway first saw each pubkey, for account ages, and when backdated posts arrived. empty restarts every account's age when the gateway restarts
+	ChannelOwnersFile                string                 `json:"channel_owners_file"`                 // file recording which pubkey owns each channel. empty keeps claims in memory, so channels have to be claimed again after a restart
+	NIP05NamesFile                   string                 `json:"nip05_names_file"`                    // file recording which pubkey claimed each NIP-05 name on the gateway's domain. empty lets the first claim ingested after a restart take each name
+	ArchiveAfterDays                 int                    `json:"archive_after_days"`                  // threads older than this stop accepting replies and votes. 0 never archives
+}
+
+// ContentFilterConfig defines one stage of the server-side content filter pipeline
+type ContentFilterConfig struct {
+	Type          string   `json:"type"`           // "keywords", "regex", "domains", "duplicates" or "rate"
+	Stage         string   `json:"stage"`          // "ingest" or "render". at ingest, duplicates and rate filters only compare a post with posts that arrived before it
+	Action        string   `json:"action"`         // ingest: "accept", "reject" or "flag". render: "hide", "collapse" or "label"
+	Label         string   `json:"label"`          // label shown on matching posts. defaults to the filter type
+	Keywords      []string `json:"keywords"`       // keywords filter: case-insensitive words or phrases
+	Patterns      []string `json:"patterns"`       // regex filter: regular expressions matched against title and body
+	Domains       []string `json:"domains"`        // domains filter: link domains, including their subdomains
+	Similarity    float64  `json:"similarity"`     // duplicates filter: word overlap (0-1) that counts as a near-duplicate. 1 only matches exact duplicates
+	WindowSeconds int      `json:"window_seconds"` // duplicates and rate filters: how far back to look
+	MaxPosts      int      `json:"max_posts"`      // rate filter: maximum posts and comments per pubkey within the window
 }
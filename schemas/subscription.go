@@ -0,0 +1,14 @@
+package schemas
+
+// KindChannelList is the replaceable event kind for a user's channel subscriptions
+// it follows the NIP-51 list layout, with one "channel" tag per subscribed channel
+const KindChannelList = 10100
+
+// SubscriptionTag is the channel list tag holding a subscribed channel
+const SubscriptionTag = "channel"
+
+// IsValidSubscription ensures that a sanitized channel name can be subscribed to
+// the "all" channel is already the global front page, so it can't be subscribed to
+func IsValidSubscription(channel string) bool {
+	return channel != "" && len(channel) <= 256
+}
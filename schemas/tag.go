@@ -0,0 +1,92 @@
+package schemas
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/rdbell/go-nostr"
+)
+
+const (
+	// MaxPostHashtags is the maximum number of hashtags kept on a post
+	MaxPostHashtags = 5
+	// MaxChannelFlair is the maximum number of flair a channel can define
+	MaxChannelFlair = 20
+	// hashtagMaxCharacters is the maximum allowed length of a hashtag
+	hashtagMaxCharacters = 30
+	// flairMaxCharacters is the maximum allowed length of a flair
+	flairMaxCharacters = 30
+)
+
+// hashtagRegexp matches the characters not allowed in a hashtag
+var hashtagRegexp = regexp.MustCompile("[^a-z0-9-_]+")
+
+// SanitizeHashtag normalizes a hashtag for publishing and DB insertion
+// NIP-12 hashtags are lowercase and don't include the leading "#"
+func SanitizeHashtag(tag string) string {
+	tag = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(tag)), "#")
+	return truncateRunes(hashtagRegexp.ReplaceAllString(tag, ""), hashtagMaxCharacters)
+}
+
+// SanitizeHashtags splits comma or space separated hashtags, normalizes them and drops duplicates
+func SanitizeHashtags(tags []string) []string {
+	var sanitized []string
+	seen := make(map[string]bool)
+	for _, field := range tags {
+		for _, tag := range strings.FieldsFunc(field, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+			tag = SanitizeHashtag(tag)
+			if tag == "" || seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			sanitized = append(sanitized, tag)
+			if len(sanitized) == MaxPostHashtags {
+				return sanitized
+			}
+		}
+	}
+	return sanitized
+}
+
+// SanitizeFlair trims a flair for publishing and DB insertion
+func SanitizeFlair(flair string) string {
+	flair = strings.Join(strings.Fields(flair), " ")
+	return truncateRunes(strings.ReplaceAll(flair, ",", ""), flairMaxCharacters)
+}
+
+// SanitizeChannelFlair splits a channel's flair, one per line, normalizes them and drops duplicates
+func SanitizeChannelFlair(flair []string) []string {
+	var sanitized []string
+	seen := make(map[string]bool)
+	for _, field := range flair {
+		for _, f := range strings.Split(field, "\n") {
+			f = SanitizeFlair(f)
+			if f == "" || seen[f] {
+				continue
+			}
+			seen[f] = true
+			sanitized = append(sanitized, f)
+			if len(sanitized) == MaxChannelFlair {
+				return sanitized
+			}
+		}
+	}
+	return sanitized
+}
+
+// HashtagsFromTags returns the NIP-12 hashtags in a nostr event's tags
+func HashtagsFromTags(tags nostr.Tags) []string {
+	var hashtags []string
+	for _, t := range tags {
+		if len(t) < 2 {
+			continue
+		}
+		if name, _ := t[0].(string); name != "t" {
+			continue
+		}
+		if value, ok := t[1].(string); ok {
+			hashtags = append(hashtags, value)
+		}
+	}
+	return SanitizeHashtags(hashtags)
+}
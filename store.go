@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/rdbell/nvote/schemas"
@@ -11,7 +12,7 @@ import (
 	checkErr "github.com/rdbell/nvote/check"
 
 	"github.com/labstack/echo/v4"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/rdbell/go-nostr"
 )
 
@@ -20,8 +21,15 @@ var db *sql.DB
 
 // initSQLite initializes the sqlite conn to an in-memory DB
 func initSQLite() {
+	// The bundled sqlite isn't compiled with math functions, so register the ranking function from Go
+	sql.Register("sqlite3_nvote", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("trusted_ranking", trustedRanking, true)
+		},
+	})
+
 	var err error
-	db, err = sql.Open("sqlite3", "file::memory:?mode=memory&cache=shared")
+	db, err = sql.Open("sqlite3_nvote", "file::memory:?mode=memory&cache=shared")
 	checkErr.Panic(err)
 	db.SetMaxOpenConns(100)
 
@@ -41,12 +49,17 @@ func initSQLite() {
 // setupPostsTables initializes the posts table in SQLite
 func setupPostsTable() {
 	_, err := db.Exec(`
-	create table posts (id TEXT NOT NULL PRIMARY KEY, score INTEGER, user_score INT, ranking FLOAT, children INTEGER, pubkey TEXT, created_at INTEGER, title TEXT, body TEXT, channel TEXT, parent TEXT);
+	create table posts (id TEXT NOT NULL PRIMARY KEY, score INTEGER, weighted_score FLOAT, user_score INT, ranking FLOAT, children INTEGER, pubkey TEXT, created_at INTEGER, posted_at INTEGER, title TEXT, body TEXT, channel TEXT, parent TEXT, root TEXT, pow INTEGER, crosspost TEXT, pending_crosspost TEXT, link TEXT, domain TEXT);
 	create INDEX posts_id ON posts(id);
 	create INDEX posts_ranking ON posts(ranking);
 	create INDEX posts_pubkey ON posts(pubkey);
 	create INDEX posts_channel ON posts(channel);
 	create INDEX posts_parent ON posts(parent);
+	create INDEX posts_root ON posts(root);
+	create INDEX posts_crosspost ON posts(crosspost);
+	create INDEX posts_pending_crosspost ON posts(pending_crosspost);
+	create INDEX posts_link ON posts(link);
+	create INDEX posts_domain ON posts(domain);
 	delete from posts;
 	`)
 	checkErr.Panic(err)
@@ -55,7 +68,7 @@ func setupPostsTable() {
 // setupUsersTable initializes the users table in SQLite
 func setupUsersTable() {
 	_, err := db.Exec(`
-	create table users (pubkey TEXT NOT NULL PRIMARY KEY, user_score INT);
+	create table users (pubkey TEXT NOT NULL PRIMARY KEY, user_score INT, first_seen INTEGER);
 	create INDEX users_pubkey ON users(pubkey);
 	delete from users;
 	`)
@@ -65,7 +78,7 @@ func setupUsersTable() {
 // setupVotesTable initializes the votes table in SQLite
 func setupVotesTable() {
 	_, err := db.Exec(`
-	create table votes (pubkey TEXT, target TEXT, channel TEXT, direction BOOLEAN, created_at INTEGER);
+	create table votes (pubkey TEXT, target TEXT, channel TEXT, direction BOOLEAN, weight FLOAT, pow INTEGER, created_at INTEGER);
 	create INDEX votes_pubkey ON votes(pubkey);
 	create INDEX votes_target ON votes(target);
 	create INDEX votes_channel ON votes(channel);
@@ -77,18 +90,246 @@ func setupVotesTable() {
 // setupMetadataTable initializes the metadata table in SQLite
 func setupMetadataTable() {
 	_, err := db.Exec(`
-	create table metadata (pubkey TEXT, name TEXT, about TEXT, created_at INTEGER);
+	create table metadata (pubkey TEXT, name TEXT, display_name TEXT, about TEXT, picture TEXT, banner TEXT, website TEXT, lud16 TEXT, nip05 TEXT, extra TEXT, raw TEXT, created_at INTEGER);
 	create UNIQUE INDEX metadata_pubkey ON metadata(pubkey);
 	delete from metadata;
 	`)
 	checkErr.Panic(err)
 }
 
+// setupListsTable initializes the replaceable lists table in SQLite
+// it keeps each user's latest list of each kind for republishing. features keep their own tables with one row per item for querying
+func setupListsTable() {
+	_, err := db.Exec(`
+	create table lists (kind INTEGER, pubkey TEXT, d TEXT, created_at INTEGER, tags TEXT, content TEXT);
+	create UNIQUE INDEX lists_kind_pubkey_d ON lists(kind, pubkey, d);
+	delete from lists;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupMutesTables initializes the mute list tables in SQLite
+// mutes holds one row per item on each user's NIP-51 mute list
+func setupMutesTables() {
+	_, err := db.Exec(`
+	create table mutes (pubkey TEXT, tag TEXT, value TEXT);
+	create INDEX mutes_pubkey_tag ON mutes(pubkey, tag);
+	delete from mutes;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupFollowsTables initializes the contact list tables in SQLite
+// follows holds one row per pubkey on each user's kind-3 contact list
+func setupFollowsTables() {
+	_, err := db.Exec(`
+	create table follows (pubkey TEXT, target TEXT);
+	create INDEX follows_pubkey ON follows(pubkey);
+	create INDEX follows_target ON follows(target);
+	delete from follows;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupSubscriptionsTables initializes the channel subscription tables in SQLite
+// subscriptions holds one row per channel on each user's subscription list
+func setupSubscriptionsTables() {
+	_, err := db.Exec(`
+	create table subscriptions (pubkey TEXT, channel TEXT);
+	create INDEX subscriptions_pubkey ON subscriptions(pubkey);
+	delete from subscriptions;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupTrustTable initializes the web-of-trust table in SQLite
+// each viewer's rows are rebuilt from the follows and mutes tables in the background
+func setupTrustTable() {
+	_, err := db.Exec(`
+	create table trust (viewer TEXT, pubkey TEXT, weight FLOAT);
+	create UNIQUE INDEX trust_viewer_pubkey ON trust(viewer, pubkey);
+	delete from trust;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupPostFlagsTable initializes the table of content filter matches, and the duplicates filter's MinHash index, in SQLite
+func setupPostFlagsTable() {
+	_, err := db.Exec(`
+	create table post_flags (post_id TEXT, stage TEXT, action TEXT, label TEXT);
+	create INDEX post_flags_post_id ON post_flags(post_id);
+	create INDEX post_flags_action ON post_flags(action);
+	create table post_shingles (post_id TEXT, band INTEGER, hash INTEGER, created_at INTEGER);
+	create INDEX post_shingles_band_hash ON post_shingles(band, hash, created_at);
+	delete from post_flags;
+	delete from post_shingles;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupChannelsTable initializes the channel definitions table in SQLite
+func setupChannelsTable() {
+	_, err := db.Exec(`
+	create table channels (name TEXT NOT NULL PRIMARY KEY, creator TEXT, created_at INTEGER, updated_at INTEGER, description TEXT, rules TEXT, banner TEXT, nsfw BOOLEAN);
+	create table channel_owners (channel TEXT NOT NULL PRIMARY KEY, pubkey TEXT);
+	create table channel_flair (channel TEXT, flair TEXT);
+	create UNIQUE INDEX channel_flair_channel_flair ON channel_flair(channel, flair);
+	delete from channels;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupPostTagsTable initializes the post hashtags and flair table in SQLite
+// flair is stored as it arrives, and the post_flair view only counts flair the post's channel defines,
+// so the result doesn't depend on whether the channel definition or the post arrives first
+func setupPostTagsTable() {
+	_, err := db.Exec(`
+	create table post_tags (post_id TEXT, tag TEXT, flair BOOLEAN);
+	create UNIQUE INDEX post_tags_post_id_tag ON post_tags(post_id, tag, flair);
+	create INDEX post_tags_tag ON post_tags(tag);
+	create VIEW post_flair AS
+		SELECT post_tags.post_id, post_tags.tag AS flair FROM post_tags
+		JOIN posts ON posts.id = post_tags.post_id
+		JOIN channel_flair ON channel_flair.channel = posts.channel AND channel_flair.flair = post_tags.tag
+		WHERE post_tags.flair;
+	delete from post_tags;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupModerationTables initializes the channel moderation tables and views in SQLite
+// pins expire by themselves, so the pin views compare against the current time whenever they're queried
+// moderator lists and actions are stored as they arrive, and the views only count actions by a moderator of the target's channel
+// or thread locks by the thread's author, so the result doesn't depend on the order events arrive from the relays
+func setupModerationTables() {
+	_, err := db.Exec(`
+	create table moderators (channel TEXT, owner TEXT, moderator TEXT);
+	create INDEX moderators_channel ON moderators(channel);
+	create table moderation_actions (id TEXT NOT NULL PRIMARY KEY, pubkey TEXT, target TEXT, action TEXT, reason TEXT, expires INTEGER, front_page BOOLEAN, created_at INTEGER);
+	create INDEX moderation_actions_target ON moderation_actions(target);
+	create VIEW channel_moderators AS
+		SELECT name AS channel, creator AS pubkey FROM channels
+		UNION SELECT moderators.channel, moderators.moderator FROM moderators JOIN channels ON channels.name = moderators.channel AND channels.creator = moderators.owner;
+	create VIEW valid_moderation_actions AS
+		SELECT moderation_actions.* FROM moderation_actions
+		JOIN posts ON posts.id = moderation_actions.target
+		JOIN channel_moderators ON channel_moderators.channel = posts.channel AND channel_moderators.pubkey = moderation_actions.pubkey
+		WHERE NOT moderation_actions.front_page;
+	create VIEW removed_posts AS
+		SELECT target, reason, created_at FROM (SELECT target, action, reason, MAX(created_at) AS created_at FROM valid_moderation_actions WHERE action IN ('remove', 'approve') GROUP BY target) WHERE action = 'remove';
+	create VIEW locked_threads AS
+		SELECT target, created_at FROM (SELECT target, action, MAX(created_at) AS created_at FROM valid_moderation_actions WHERE action IN ('lock', 'unlock') GROUP BY target) WHERE action = 'lock';
+	create VIEW author_locked_threads AS
+		SELECT target, created_at FROM (SELECT moderation_actions.target, moderation_actions.action, MAX(moderation_actions.created_at) AS created_at FROM moderation_actions
+			JOIN posts ON posts.id = moderation_actions.target AND posts.pubkey = moderation_actions.pubkey AND posts.root = posts.id
+			WHERE moderation_actions.action IN ('lock', 'unlock') AND NOT moderation_actions.front_page GROUP BY moderation_actions.target) WHERE action = 'lock';
+	create VIEW closed_threads AS
+		SELECT target, created_at FROM locked_threads UNION ALL SELECT target, created_at FROM author_locked_threads;
+	create VIEW pinned_posts AS
+		SELECT target, expires, created_at FROM (SELECT target, action, expires, MAX(created_at) AS created_at FROM valid_moderation_actions WHERE action IN ('pin', 'unpin') GROUP BY target)
+		WHERE action = 'pin' AND (expires = 0 OR expires > CAST(strftime('%s', 'now') AS INTEGER));
+	create VIEW announced_posts AS
+		SELECT target, expires, created_at FROM (SELECT target, action, expires, MAX(created_at) AS created_at FROM moderation_actions
+			WHERE front_page AND action IN ('pin', 'unpin') AND pubkey IN (SELECT pubkey FROM operators) GROUP BY target)
+		WHERE action = 'pin' AND (expires = 0 OR expires > CAST(strftime('%s', 'now') AS INTEGER));
+	create VIEW operator_actions AS
+		SELECT * FROM moderation_actions WHERE pubkey IN (SELECT pubkey FROM operators);
+	create VIEW gateway_hidden_posts AS
+		SELECT target, created_at FROM (SELECT target, action, MAX(created_at) AS created_at FROM operator_actions WHERE action IN ('hide', 'unhide') GROUP BY target) WHERE action = 'hide';
+	create VIEW gateway_hidden_users AS
+		SELECT target, created_at FROM (SELECT target, action, MAX(created_at) AS created_at FROM operator_actions WHERE action IN ('hide_user', 'unhide_user') GROUP BY target) WHERE action = 'hide_user';
+	delete from moderators;
+	delete from moderation_actions;
+	`)
+	checkErr.Panic(err)
+
+	setupOperatorsTable()
+}
+
+// setupOperatorsTable initializes the table of gateway operator pubkeys in SQLite from the config, so views can refer to them
+func setupOperatorsTable() {
+	_, err := db.Exec(`
+	create table operators (pubkey TEXT NOT NULL PRIMARY KEY);
+	delete from operators;
+	`)
+	checkErr.Panic(err)
+
+	for _, pubkey := range appConfig.Operators {
+		_, err = db.Exec(`INSERT OR IGNORE INTO operators(pubkey) VALUES(?)`, strings.ToLower(pubkey))
+		checkErr.Panic(err)
+	}
+}
+
+// setupReportsTable initializes the NIP-56 reports table in SQLite
+// each reporter's latest report on a post or user replaces their earlier ones
+func setupReportsTable() {
+	_, err := db.Exec(`
+	create table reports (id TEXT NOT NULL PRIMARY KEY, pubkey TEXT, event TEXT, target TEXT, type TEXT, comment TEXT, created_at INTEGER, seen_at INTEGER);
+	create UNIQUE INDEX reports_pubkey_event_target ON reports(pubkey, event, target);
+	create INDEX reports_event_target ON reports(event, target);
+	delete from reports;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupBlocklistTables initializes the operators' blocklist tables in SQLite
+// blocked_links records posts that were already stored when their link's domain was blocked
+func setupBlocklistTables() {
+	_, err := db.Exec(`
+	create table blocklist (type TEXT, value TEXT, reason TEXT, created_at INTEGER);
+	create UNIQUE INDEX blocklist_type_value ON blocklist(type, value);
+	create table blocked_links (post_id TEXT, domain TEXT);
+	create INDEX blocked_links_post_id ON blocked_links(post_id);
+	delete from blocklist;
+	delete from blocked_links;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupKarmaTables initializes the per-channel karma tables in SQLite
+// karma holds each user's running totals, karma_history the change on each day, so daily snapshots are running sums
+func setupKarmaTables() {
+	_, err := db.Exec(`
+	create table karma (pubkey TEXT, channel TEXT, post_karma INTEGER, comment_karma INTEGER);
+	create UNIQUE INDEX karma_pubkey_channel ON karma(pubkey, channel);
+	create table karma_history (pubkey TEXT, channel TEXT, day INTEGER, post_karma INTEGER, comment_karma INTEGER);
+	create UNIQUE INDEX karma_history_pubkey_channel_day ON karma_history(pubkey, channel, day);
+	delete from karma;
+	delete from karma_history;
+	`)
+	checkErr.Panic(err)
+}
+
+// setupNIP05NamesTable initializes the table of NIP-05 names claimed on this gateway's domain
+func setupNIP05NamesTable() {
+	_, err := db.Exec(`
+	create table nip05_names (name TEXT NOT NULL PRIMARY KEY, pubkey TEXT, created_at INTEGER);
+	create INDEX nip05_names_pubkey ON nip05_names(pubkey);
+	delete from nip05_names;
+	`)
+	checkErr.Panic(err)
+}
+
+// relayCatchUpDelay is how long after starting the gateway is assumed to still be receiving the relays' stored events
+// the DB is rebuilt from the relays on every start, so until then events are missing or arrive long after they were created
+const relayCatchUpDelay = 10 * time.Minute
+
+// maxClockSkew is how far an event's timestamp may be ahead of the gateway's clock, or behind when it arrives live
+const maxClockSkew = 5 * 60
+
+// caughtUp returns true once the gateway has had time to receive the relays' stored events
+func caughtUp() bool {
+	return time.Since(time.Unix(int64(adminState.startedAt), 0)) >= relayCatchUpDelay
+}
+
 // fetchEvents sets up the nostr relay pool and subscribes to events
 func fetchEvents() {
 	pool = nostr.NewRelayPool()
 	for _, relay := range appConfig.Relays {
-		pool.Add(relay, &nostr.SimplePolicy{Read: true, Write: true})
+		if err := pool.Add(relay, &nostr.SimplePolicy{Read: true, Write: true}); err != nil {
+			log.Printf("unable to connect to %s: %s\n", relay, err)
+			recordError(relay, err)
+		}
 	}
 
 	if len(pool.Relays) == 0 {
@@ -98,13 +339,14 @@ func fetchEvents() {
 	go func() {
 		for notice := range pool.Notices {
 			log.Printf("%s has sent a notice: '%s'\n", notice.Relay, notice.Message)
+			recordNotice(notice)
 		}
 	}()
 
 	// Get nostr events
 	sub := pool.Sub(nostr.EventFilters{
 		{
-			Kinds: []int{nostr.KindTextNote, nostr.KindSetMetadata, nostr.KindDeletion},
+			Kinds: []int{nostr.KindTextNote, nostr.KindSetMetadata, nostr.KindDeletion, nostr.KindContactList, schemas.KindMuteList, schemas.KindChannelList, schemas.KindChannelDefinition, schemas.KindModeratorList, schemas.KindModerationAction, schemas.KindReport},
 		},
 	})
 
@@ -113,14 +355,81 @@ func fetchEvents() {
 
 			// Validate event signature
 			if ok, _ := event.CheckSignature(); !ok {
+				recordDrop("signature")
 				continue
 			}
+			recordIngest(event.Kind)
+
+			// Drop blocked events, and everything from blocked pubkeys
+			if isBlockedEvent(&event) {
+				recordDrop("blocklist")
+				continue
+			}
+
+			// Track account age from the earliest event seen for each pubkey
+			touchUser(event.PubKey, event.CreatedAt)
 
 			// Handle post deletion
 			if event.Kind == nostr.KindDeletion {
 				deletePost(&event)
 			}
 
+			// Handle mute list update
+			if event.Kind == schemas.KindMuteList {
+				if muteList, err := schemas.ListFromEvent(&event, schemas.KindMuteList); err == nil {
+					upsertMuteList(muteList)
+				}
+				continue
+			}
+
+			// Handle channel subscription list update
+			if event.Kind == schemas.KindChannelList {
+				if channelList, err := schemas.ListFromEvent(&event, schemas.KindChannelList); err == nil {
+					upsertChannelList(channelList)
+				}
+				continue
+			}
+
+			// Handle channel definition
+			if event.Kind == schemas.KindChannelDefinition {
+				if channel, err := schemas.ChannelFromEvent(&event); err == nil {
+					upsertChannel(channel)
+				}
+				continue
+			}
+
+			// Handle moderator list update
+			if event.Kind == schemas.KindModeratorList {
+				if moderatorList, err := schemas.ListFromEvent(&event, schemas.KindModeratorList); err == nil {
+					upsertModeratorList(moderatorList)
+				}
+				continue
+			}
+
+			// Handle moderation action
+			if event.Kind == schemas.KindModerationAction {
+				if action, err := schemas.ModerationActionFromEvent(&event); err == nil {
+					insertModerationAction(action)
+				}
+				continue
+			}
+
+			// Handle report
+			if event.Kind == schemas.KindReport {
+				if report, err := schemas.ReportFromEvent(&event); err == nil {
+					insertReport(report)
+				}
+				continue
+			}
+
+			// Handle contact list update
+			if event.Kind == nostr.KindContactList {
+				if contactList, err := schemas.ListFromEvent(&event, nostr.KindContactList); err == nil {
+					upsertContactList(contactList)
+				}
+				continue
+			}
+
 			// Handle metadata update
 			if event.Kind == nostr.KindSetMetadata {
 				if metadata, err := schemas.MetadataFromEvent(&event); err == nil {
@@ -131,19 +440,61 @@ func fetchEvents() {
 
 			// Attempt vote insert
 			if vote, err := schemas.VoteFromEvent(&event); err == nil {
+				vote.PoW = eventDifficulty(&event)
+				if !powVoteAccepted(vote.PoW) {
+					recordDrop("proof-of-work")
+					continue
+				}
 				insertVote(vote)
 				continue
 			}
 
 			// Attempt post insert
 			if post, err := schemas.PostFromEvent(&event); err == nil {
-				insertPost(post)
+				// Every relay sends its own copy of an event. only the first copy is stored
+				if postExists(post.ID) {
+					continue
+				}
+				post.PoW = eventDifficulty(&event)
+				if !powAccepted(post) {
+					recordDrop("proof-of-work")
+					continue
+				}
+				if isBlockedPost(post) {
+					recordDrop("blocklist")
+					continue
+				}
+				post.PostedAt = postedAt(post)
+				if !replyAccepted(post) {
+					recordDrop("closed thread")
+					continue
+				}
+				accepted, flags := filterPost(post)
+				if !accepted {
+					recordDrop("filters")
+					continue
+				}
+				if err := insertPost(post); err != nil {
+					if !isConstraintError(err) {
+						recordError("ingest "+post.ID, err)
+					}
+					continue
+				}
+				insertPostFlags(post.ID, flags)
+				filterLaterPosts(post)
+				insertPostTags(post)
 				continue
 			}
 		}
 	}()
 }
 
+// isConstraintError returns true if a DB error is a constraint violation, such as inserting a post that's already stored
+func isConstraintError(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint
+}
+
 // publishEvent submits a user's event to the nostr network
 func publishEvent(c echo.Context, content []byte, kind int, tags nostr.Tags) (*nostr.Event, error) {
 	if tags == nil {
@@ -163,9 +514,21 @@ func publishEvent(c echo.Context, content []byte, kind int, tags nostr.Tags) (*n
 		clearCookie(c, "user")
 		return event, errors.New("invalid keypair")
 	}
+	event.PubKey = pub
+
+	// Mine proof-of-work for the ingest filters, and for unverified users if the gateway allows it
+	difficulty := powRequired(kind, content)
+	if powAllowsUnverified() && appConfig.PoWPublishDifficulty > difficulty {
+		if verified, _ := checkVerification(pub); !verified {
+			difficulty = appConfig.PoWPublishDifficulty
+		}
+	}
+	err = mineEvent(event, difficulty)
+	if err != nil {
+		return event, err
+	}
 
 	// Sign event
-	event.PubKey = pub
 	err = event.Sign(c.Get("user").(*schemas.User).PrivKey)
 
 	if err != nil {
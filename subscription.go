@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// subscriptionRoutes sets up channel subscription routes
+func subscriptionRoutes(e *echo.Echo) {
+	e.POST("/subscribe", isLoggedIn(subscribeSubmitHandler))
+}
+
+// subscribeForm defines a subscribe/unsubscribe request
+type subscribeForm struct {
+	Channel     string `form:"channel"`     // channel to subscribe to
+	Unsubscribe bool   `form:"unsubscribe"` // remove the channel from the subscription list instead of adding it
+}
+
+// subscribeSubmitHandler adds or removes a channel on the user's subscription list and republishes it
+func subscribeSubmitHandler(c echo.Context) error {
+	form := &subscribeForm{}
+	if err := c.Bind(form); err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	form.Channel = schemas.SanitizeChannel(form.Channel)
+	if !schemas.IsValidSubscription(form.Channel) {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid channel"))
+	}
+
+	// Publish subscription list update event
+	err := publishListChange(c, schemas.KindChannelList, "", schemas.SubscriptionTag, form.Channel, form.Unsubscribe)
+	if err != nil {
+		return serveListChangeError(c, err)
+	}
+
+	// Attempt redirect back to page that the user came from
+	return redirectBack(c, "/c/"+form.Channel)
+}
+
+// channelListForPubkey queries the DB and returns a pubkey's latest channel subscription list
+func channelListForPubkey(pubkey string) (*schemas.List, error) {
+	return listForPubkey(schemas.KindChannelList, pubkey, "")
+}
+
+// upsertChannelList replaces a user's channel subscription list in the DB if the supplied list is newer
+func upsertChannelList(channelList *schemas.List) error {
+	err := upsertList(channelList)
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the queryable rows for this list
+	_, err = db.Exec(`DELETE FROM subscriptions WHERE pubkey = ?`, channelList.PubKey)
+	if err != nil {
+		return err
+	}
+
+	for _, channel := range channelList.Values(schemas.SubscriptionTag) {
+		channel = schemas.SanitizeChannel(channel)
+		if !schemas.IsValidSubscription(channel) {
+			continue
+		}
+		db.Exec(`INSERT INTO subscriptions(pubkey, channel) VALUES(?,?)`, channelList.PubKey, channel)
+	}
+
+	return nil
+}
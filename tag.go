@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// tagRoutes sets up hashtag routes
+func tagRoutes(e *echo.Echo) {
+	e.GET("/t/:tag", viewPostsHandler)
+}
+
+// insertPostTags stores a post's hashtags and flair in the DB
+func insertPostTags(post *schemas.Post) {
+	for _, tag := range post.Hashtags {
+		db.Exec(`INSERT OR IGNORE INTO post_tags(post_id, tag, flair) VALUES(?,?,?)`, post.ID, tag, false)
+	}
+	if post.Flair != "" && post.Parent == "" {
+		db.Exec(`INSERT OR IGNORE INTO post_tags(post_id, tag, flair) VALUES(?,?,?)`, post.ID, post.Flair, true)
+	}
+}
+
+// tagPosts fills the hashtags of a page's posts, and their flair if the post's channel defines it
+func tagPosts(posts []*schemas.Post) {
+	byID, in, args := postsByID(posts)
+	for _, post := range posts {
+		post.Hashtags = nil
+		post.Flair = ""
+	}
+
+	rows, err := db.Query(`SELECT post_id, tag FROM post_tags WHERE NOT flair AND post_id IN (`+in+`) ORDER BY rowid`, args...)
+	if err == nil {
+		for rows.Next() {
+			var id, tag string
+			if rows.Scan(&id, &tag) != nil {
+				continue
+			}
+			for _, post := range byID[id] {
+				post.Hashtags = append(post.Hashtags, tag)
+			}
+		}
+		rows.Close()
+	}
+
+	rows, err = db.Query(`SELECT post_id, flair FROM post_flair WHERE post_id IN (`+in+`)`, args...)
+	if err == nil {
+		for rows.Next() {
+			var id, flair string
+			if rows.Scan(&id, &flair) != nil {
+				continue
+			}
+			for _, post := range byID[id] {
+				post.Flair = flair
+			}
+		}
+		rows.Close()
+	}
+}
+
+// channelFlair queries the DB and returns the flair a channel defines
+func channelFlair(name string) []string {
+	var flair []string
+
+	rows, err := db.Query(`SELECT flair FROM channel_flair WHERE channel = ? ORDER BY rowid`, name)
+	if err != nil {
+		return flair
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f string
+		if rows.Scan(&f) == nil {
+			flair = append(flair, f)
+		}
+	}
+
+	return flair
+}
+
+// hasFlair returns true if a channel defines a flair
+func hasFlair(channel string, flair string) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM channel_flair WHERE channel = ? AND flair = ?`, channel, flair).Scan(&count)
+	return count > 0
+}
+
+// upsertChannelFlair replaces a channel's flair in the DB
+func upsertChannelFlair(channel *schemas.Channel) error {
+	_, err := db.Exec(`DELETE FROM channel_flair WHERE channel = ?`, channel.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, flair := range channel.Flair {
+		_, err = db.Exec(`INSERT OR IGNORE INTO channel_flair(channel, flair) VALUES(?,?)`, channel.Name, flair)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -29,6 +29,9 @@ var appConfig *schemas.AppConfig
 type pageData struct {
 	Config    *schemas.AppConfig
 	User      *schemas.User
+	Mutes     *schemas.List
+	Follows   *schemas.List
+	Channels  *schemas.List
 	Title     string
 	Page      interface{}
 	CsrfToken string
@@ -42,6 +45,9 @@ func (p *pageData) Init(c echo.Context) *pageData {
 	}
 	p.Config = appConfig
 	p.User = user
+	p.Mutes, _ = muteListForPubkey(user.PubKey)
+	p.Follows, _ = contactListForPubkey(user.PubKey)
+	p.Channels, _ = channelListForPubkey(user.PubKey)
 	p.CsrfToken, _ = c.Get("csrf").(string)
 	return p
 }
@@ -87,6 +93,9 @@ func loadTemplates(box *packr.Box) {
 		"floatToString": func(val float32) string {
 			return fmt.Sprintf("%.2f", val)
 		},
+		"percent": func(val float64) string {
+			return fmt.Sprintf("%.0f%%", val*100)
+		},
 		"timeAgo": func(ts uint32) string {
 			t := time.Unix(int64(ts), 0)
 			timeAgo, err := timeago.TimeAgoWithTime(time.Now(), t)
@@ -96,6 +105,9 @@ func loadTemplates(box *packr.Box) {
 
 			return strings.ToLower(timeAgo)
 		},
+		"duration": func(seconds uint32) string {
+			return formatDuration(seconds)
+		},
 		"cacheBuster": func() string {
 			return cacheBuster
 		},
@@ -127,8 +139,25 @@ func loadTemplates(box *packr.Box) {
 			return s
 		},
 		"isVerified": func(pubkey string) bool {
-			verified, _ := checkVerification(pubkey)
-			return verified
+			// Never block rendering on the verification backend
+			return peekVerification(pubkey)
+		},
+		"canPost": func(pubkey string) bool {
+			if pubkey == "" {
+				return false
+			}
+
+			// Unverified users can post with proof-of-work if the gateway allows it
+			return powAllowsUnverified() || peekVerification(pubkey)
+		},
+		"isMuted": func(mutes *schemas.List, tag string, value string) bool {
+			return mutes.Contains(tag, value)
+		},
+		"isFollowing": func(follows *schemas.List, pubkey string) bool {
+			return follows.Contains(schemas.FollowTag, pubkey)
+		},
+		"isSubscribed": func(channels *schemas.List, channel string) bool {
+			return channels.Contains(schemas.SubscriptionTag, channel)
 		},
 		"hasVoted": func(votes []*schemas.Vote, target string) string {
 			for _, vote := range votes {
@@ -173,6 +202,35 @@ func loadTemplates(box *packr.Box) {
 			}
 			return metadata.Name
 		},
+		"pubkeyMetadata": func(pubkey string) *schemas.Metadata {
+			// Query DB for all profile fields
+			metadata, _ := metadataForPubkey(pubkey)
+			if metadata == nil {
+				return &schemas.Metadata{}
+			}
+
+			return metadata
+		},
+		"lightningURL": func(address string) template.URL {
+			// Lightning addresses are validated on ingest, see schemas.Metadata.Sanitize
+			return template.URL("lightning:" + address)
+		},
+		"pubkeyNIP05": func(pubkey string) string {
+			// Query DB for NIP-05 identifier
+			metadata, _ := metadataForPubkey(pubkey)
+			if metadata == nil {
+				return ""
+			}
+
+			return metadata.NIP05
+		},
+		"verifiedNIP05": func(pubkey string) string {
+			// Read from the background-verified NIP-05 cache
+			return verifiedNIP05(pubkey)
+		},
+		"siteHost": func() string {
+			return siteHost()
+		},
 		"pubkeyAbout": func(pubkey string) string {
 			// Query DB for bio
 			metadata, _ := metadataForPubkey(pubkey)
@@ -239,6 +297,37 @@ func loadTemplates(box *packr.Box) {
 			// Text post
 			return "text"
 		},
+		"isOperator": func(pubkey string) bool {
+			return isOperator(pubkey)
+		},
+		"isHiddenUser": func(pubkey string) bool {
+			return isHiddenUser(pubkey)
+		},
+		"reportTypes": func() []string {
+			return schemas.ReportTypes
+		},
+		"linkHost": linkHost,
+		"crosspostOrigin": func(id string) *schemas.Post {
+			original, _ := crosspostOrigin(id)
+			return original
+		},
+		"channelFlair": func(name string) []string {
+			return channelFlair(schemas.SanitizeChannel(name))
+		},
+		"timeUntil": func(ts uint32) string {
+			now := uint32(time.Now().Unix())
+			if ts <= now {
+				return ""
+			}
+			return formatDuration(ts - now)
+		},
+		"weightedScore": func(post *schemas.Post) string {
+			// Empty unless vote weighting is enabled, so templates can show the raw score alone
+			if !appConfig.VoteWeighting {
+				return ""
+			}
+			return fmt.Sprintf("weighted score: %.1f", post.WeightedScore)
+		},
 		"score": func(score int32) int32 {
 			if score < 0 {
 				return 0
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rdbell/nvote/schemas"
@@ -70,7 +74,17 @@ func altLoginHandler(c echo.Context) error {
 
 // settingsHandler serves the settings page
 func settingsHandler(c echo.Context) error {
+	var page struct {
+		Verified bool
+	}
+
+	// Profile fields are only editable by verified users
+	// check here rather than in the template, which shouldn't block on the verification backend
+	// a backend error hides the profile fields rather than the whole settings page
+	page.Verified, _ = checkVerification(c.Get("user").(*schemas.User).PubKey)
+
 	pd := new(pageData).Init(c)
+	pd.Page = page
 	pd.Title = "Settings"
 	return c.Render(http.StatusOK, "base:settings", pd)
 }
@@ -125,16 +139,51 @@ func settingsSubmitHandler(c echo.Context) error {
 		return serveError(c, http.StatusInternalServerError, errors.New("invalid user object - try logging out"))
 	}
 
+	// Profile fields are only shown to verified users. Don't publish blank metadata for everyone else
+	// the form only sends them if they were shown, and a backend error is treated as unverified so other settings can still be saved
+	verified := false
+	if c.FormValue("profile") == "true" {
+		verified, _ = checkVerification(user.PubKey)
+	}
+
 	// Query for existing metadata
 	metadata, _ := metadataForPubkey(user.PubKey)
 
-	// Upsert metadata if changed
-	if (metadata != nil && user.Name != metadata.Name) || (metadata == nil && user.Name != "") || (metadata != nil && user.About != metadata.About) || (metadata == nil && user.About != "") {
-		metadata := &schemas.Metadata{
-			PubKey: user.PubKey,
-			Name:   user.Name,
-			About:  user.About,
+	// Apply profile fields from the settings form, keeping fields set by other clients
+	updated := &schemas.Metadata{
+		PubKey:      user.PubKey,
+		Name:        user.Name,
+		DisplayName: user.DisplayName,
+		About:       user.About,
+		Picture:     user.Picture,
+		Banner:      user.Banner,
+		Website:     user.Website,
+		Lud16:       user.Lud16,
+		NIP05:       user.NIP05,
+		Extra:       metadata.Extra,
+	}
+
+	// Stored metadata is sanitized, so sanitize the form input before comparing
+	updated.Sanitize()
+
+	publish := verified && !updated.ProfileEquals(metadata)
+
+	var content []byte
+	if !verified && appConfig.VerificationBackend == verificationBackendNIP05 {
+		// With the nip05 backend, unverified users can only set the NIP-05 identifier that verifies them
+		// the rest of their published profile is republished exactly as it was, not as nvote stored it
+		if updated.NIP05 != metadata.NIP05 {
+			published, err := rawMetadataForPubkey(user.PubKey)
+			if err != nil {
+				published = &schemas.Metadata{PubKey: user.PubKey}
+			}
+			content, err = published.ContentWithNIP05(updated.NIP05)
+			if err != nil {
+				return serveError(c, http.StatusInternalServerError, err)
+			}
 		}
+	} else if publish {
+		metadata := updated
 
 		// Validate new metadata
 		metadata.PrepareForPublish()
@@ -143,12 +192,14 @@ func settingsSubmitHandler(c echo.Context) error {
 		}
 
 		// Serialize data
-		content, err := json.Marshal(metadata)
+		content, err = metadata.Content()
 		if err != nil {
 			return serveError(c, http.StatusInternalServerError, err)
 		}
+	}
 
-		// Publish metadata update event
+	// Publish metadata update event if changed
+	if content != nil {
 		_, err = publishEvent(c, content, nostr.KindSetMetadata, nil)
 		if err != nil {
 			return serveError(c, http.StatusInternalServerError, err)
@@ -156,8 +207,15 @@ func settingsSubmitHandler(c echo.Context) error {
 	}
 
 	// Save cookie
+	user.SanitizeThresholds()
 	user.Name = ""  // don't need to save user.name client-side
 	user.About = "" // don't need to save user.about client-side
+	user.NIP05 = "" // don't need to save user.nip05 client-side
+	user.DisplayName = ""
+	user.Picture = ""
+	user.Banner = ""
+	user.Website = ""
+	user.Lud16 = ""
 	userJSON, err := json.Marshal(user)
 	if err != nil {
 		return serveError(c, http.StatusInternalServerError, err)
@@ -193,18 +251,112 @@ func generatedUsername(pubkey string) string {
 
 // metadataForPubkey queries the DB and returns a *schemas.Metadata for a given pubkey
 func metadataForPubkey(pubkey string) (*schemas.Metadata, error) {
+	metadata, err := rawMetadataForPubkey(pubkey)
+	if err != nil {
+		metadata = &schemas.Metadata{}
+		metadata.PubKey = pubkey
+	}
+
+	metadata.UserScore = karmaTotal(pubkey)
+	if metadata.Name == "" {
+		metadata.Name = generatedUsername(pubkey)
+	}
+
+	return metadata, nil
+}
+
+// rawMetadataForPubkey queries the DB and returns a pubkey's last published metadata, without generated defaults
+// fields are sanitized. Raw holds the event content exactly as it was published
+func rawMetadataForPubkey(pubkey string) (*schemas.Metadata, error) {
 	metadata := &schemas.Metadata{}
 	metadata.PubKey = pubkey
 
-	db.QueryRow(`SELECT SUM(score) FROM posts WHERE pubkey = ?`, pubkey).Scan(&metadata.UserScore)
-	err := db.QueryRow(`SELECT name, about, created_at FROM metadata WHERE pubkey = ?`, pubkey).Scan(&metadata.Name, &metadata.About, &metadata.CreatedAt)
-	if err != nil || metadata.Name == "" {
-		metadata.Name = generatedUsername(pubkey)
+	var extra string
+	err := db.QueryRow(`SELECT name, display_name, about, picture, banner, website, lud16, nip05, extra, COALESCE(raw, ''), created_at FROM metadata WHERE pubkey = ?`, pubkey).Scan(
+		&metadata.Name, &metadata.DisplayName, &metadata.About, &metadata.Picture, &metadata.Banner, &metadata.Website, &metadata.Lud16, &metadata.NIP05, &extra, &metadata.Raw, &metadata.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
 	}
+	json.Unmarshal([]byte(extra), &metadata.Extra)
 
 	return metadata, nil
 }
 
+// gatewaySeen holds when this gateway first ingested an event from each pubkey, and when backdated posts arrived (see postedAt)
+// event timestamps are chosen by the sender, so this bounds account ages. it's kept in the first seen file, since the DB is rebuilt on every start
+var gatewaySeen = struct {
+	sync.Mutex
+	at   map[string]uint32
+	file *os.File
+}{
+	at: make(map[string]uint32),
+}
+
+// loadFirstSeen reads the first seen file and opens it for appending newly seen pubkeys
+// each line holds a pubkey and the unix timestamp it was first seen at, separated by whitespace
+func loadFirstSeen() {
+	if appConfig.FirstSeenFile == "" {
+		return
+	}
+
+	file, err := os.OpenFile(appConfig.FirstSeenFile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		panic("unable to open first seen file: " + err.Error())
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		seen, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		if at, ok := gatewaySeen.at[fields[0]]; !ok || uint32(seen) < at {
+			gatewaySeen.at[fields[0]] = uint32(seen)
+		}
+	}
+
+	gatewaySeen.file = file
+	log.Printf("loaded %d first seen times\n", len(gatewaySeen.at))
+}
+
+// gatewayFirstSeen returns when this gateway first saw a pubkey, recording the current time if it's new
+func gatewayFirstSeen(pubkey string) uint32 {
+	gatewaySeen.Lock()
+	defer gatewaySeen.Unlock()
+
+	if at, ok := gatewaySeen.at[pubkey]; ok {
+		return at
+	}
+
+	now := uint32(time.Now().Unix())
+	gatewaySeen.at[pubkey] = now
+	if gatewaySeen.file != nil {
+		fmt.Fprintf(gatewaySeen.file, "%s %d\n", pubkey, now)
+	}
+
+	return now
+}
+
+// touchUser records a pubkey in the users table, keeping the timestamp of its earliest known event
+// the timestamp is clamped to the current time, and to no earlier than this gateway first saw the pubkey, so backdated events don't age an account
+func touchUser(pubkey string, createdAt uint32) error {
+	if now := uint32(time.Now().Unix()); createdAt > now {
+		createdAt = now
+	}
+	if seen := gatewayFirstSeen(pubkey); createdAt < seen {
+		createdAt = seen
+	}
+
+	_, err := db.Exec(`INSERT INTO users(pubkey, user_score, first_seen) VALUES(?,?,?) ON CONFLICT (pubkey) DO UPDATE SET first_seen=MIN(COALESCE(first_seen, excluded.first_seen), excluded.first_seen)`,
+		pubkey, 0, createdAt)
+	return err
+}
+
 // upsertMetadata upserts a user's metadata into the DB
 func upsertMetadata(metadata *schemas.Metadata) error {
 	// Sanitize before upsert
@@ -215,11 +367,27 @@ func upsertMetadata(metadata *schemas.Metadata) error {
 		return errors.New("invalid metadata")
 	}
 
-	// Add to DB
-	_, err := db.Exec(`INSERT INTO metadata(pubkey, name, about, created_at) VALUES(?,?,?,?) ON CONFLICT (pubkey) DO UPDATE SET name=?, about=?, created_at=?`,
-		metadata.PubKey, metadata.Name, metadata.About, metadata.CreatedAt, metadata.Name, metadata.About, metadata.CreatedAt)
+	extra, err := json.Marshal(metadata.Extra)
 	if err != nil {
 		return err
 	}
+
+	// Add to DB. relays can deliver an older kind-0 after a newer one, which must not replace it
+	result, err := db.Exec(`INSERT INTO metadata(pubkey, name, display_name, about, picture, banner, website, lud16, nip05, extra, raw, created_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)
+		ON CONFLICT (pubkey) DO UPDATE SET name=excluded.name, display_name=excluded.display_name, about=excluded.about, picture=excluded.picture, banner=excluded.banner,
+		website=excluded.website, lud16=excluded.lud16, nip05=excluded.nip05, extra=excluded.extra, raw=excluded.raw, created_at=excluded.created_at
+		WHERE excluded.created_at > metadata.created_at`,
+		metadata.PubKey, metadata.Name, metadata.DisplayName, metadata.About, metadata.Picture, metadata.Banner, metadata.Website, metadata.Lud16, metadata.NIP05, string(extra), metadata.Raw, metadata.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return nil
+	}
+
+	// Claim names on this gateway's domain and queue the identifier for verification
+	claimNIP05Name(metadata)
+	queueNIP05Check(metadata.PubKey, metadata.NIP05)
+
 	return nil
 }
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rdbell/nvote/schemas"
+)
+
+const (
+	// verificationBackendRelay checks a pubkey's paid registration with the nostr relay
+	verificationBackendRelay = "relay"
+	// verificationBackendAllowlist checks a pubkey against a static allowlist file
+	verificationBackendAllowlist = "allowlist"
+	// verificationBackendNIP05 checks that a pubkey has a verified NIP-05 identifier on an accepted domain
+	verificationBackendNIP05 = "nip05"
+	// verificationBackendPoW checks that a pubkey was mined with enough leading zero bits
+	verificationBackendPoW = "pow"
+	// verificationBackendNone treats every pubkey as verified
+	verificationBackendNone = "none"
+)
+
+// verifier decides whether a pubkey is allowed to post and vote
+type verifier interface {
+	Verify(pubkey string) (bool, error)
+}
+
+// accountVerifier is the verifier configured for this gateway
+var accountVerifier *cachedVerifier
+
+// initVerifier sets up the verification backend selected in the app config
+func initVerifier() {
+	// Fall back to the relay registration check if a check URL is configured
+	if appConfig.VerificationBackend == "" {
+		appConfig.VerificationBackend = verificationBackendNone
+		if appConfig.CheckVerifiedBaseURL != "" {
+			appConfig.VerificationBackend = verificationBackendRelay
+		}
+	}
+
+	var v verifier
+	switch appConfig.VerificationBackend {
+	case verificationBackendRelay:
+		v = &relayRegistrationVerifier{baseURL: appConfig.CheckVerifiedBaseURL}
+	case verificationBackendAllowlist:
+		v = newAllowlistVerifier(appConfig.VerificationAllowlistFile)
+	case verificationBackendNIP05:
+		v = &nip05DomainVerifier{domains: appConfig.VerificationNIP05Domains}
+	case verificationBackendPoW:
+		v = &powVerifier{difficulty: appConfig.VerificationPoWDifficulty}
+	case verificationBackendNone:
+		v = &alwaysVerifier{}
+	default:
+		panic("unknown verification backend: " + appConfig.VerificationBackend)
+	}
+
+	positiveTTL := time.Duration(appConfig.VerificationCacheSeconds) * time.Second
+	if positiveTTL <= 0 {
+		positiveTTL = 5 * time.Minute
+	}
+	negativeTTL := time.Duration(appConfig.VerificationNegativeCacheSeconds) * time.Second
+	if negativeTTL <= 0 {
+		negativeTTL = 30 * time.Second
+	}
+
+	accountVerifier = &cachedVerifier{
+		verifier:    v,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		results:     make(map[string]*verificationResult),
+		calls:       make(map[string]*verificationCall),
+		slots:       make(chan struct{}, maxVerificationLookups),
+	}
+}
+
+// checkVerification returns true if a pubkey is verified with the configured backend
+// this may block on network I/O. Templates should use peekVerification instead
+func checkVerification(pubkey string) (bool, error) {
+	return accountVerifier.Verify(pubkey)
+}
+
+// peekVerification returns the last known verification state for a pubkey without blocking
+func peekVerification(pubkey string) bool {
+	return accountVerifier.Peek(pubkey)
+}
+
+// cachedVerification returns the last known verification state for a pubkey, however old, without starting a lookup
+// background jobs use this so they don't send every known pubkey to the backend
+func cachedVerification(pubkey string) bool {
+	verified, _ := accountVerifier.cached(pubkey)
+	return verified
+}
+
+// maxVerificationLookups caps concurrent lookups against the verification backend, e.g. while ingest backfills many new voters
+const maxVerificationLookups = 8
+
+// verificationResult defines a cached verification lookup
+type verificationResult struct {
+	Verified  bool
+	CheckedAt time.Time
+}
+
+// verificationCall defines an in-flight verification lookup that concurrent callers can wait on
+type verificationCall struct {
+	done     chan struct{}
+	verified bool
+	err      error
+}
+
+// cachedVerifier caches another verifier's results and coalesces concurrent lookups for the same pubkey
+// positive and negative results expire separately, so newly verified users don't wait out a long TTL
+type cachedVerifier struct {
+	sync.Mutex
+	verifier    verifier
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	results     map[string]*verificationResult
+	calls       map[string]*verificationCall
+	slots       chan struct{}
+}
+
+// Verify returns a fresh cached result, or waits for a lookup with the wrapped verifier
+func (v *cachedVerifier) Verify(pubkey string) (bool, error) {
+	if verified, fresh := v.cached(pubkey); fresh {
+		return verified, nil
+	}
+
+	call := v.lookup(pubkey)
+	<-call.done
+	return call.verified, call.err
+}
+
+// Peek returns the last known result without blocking
+// missing or stale results are refreshed in the background
+func (v *cachedVerifier) Peek(pubkey string) bool {
+	verified, fresh := v.cached(pubkey)
+	if !fresh {
+		v.lookup(pubkey)
+	}
+	return verified
+}
+
+// cached returns the cached result for a pubkey and whether it is still fresh
+func (v *cachedVerifier) cached(pubkey string) (bool, bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	result, ok := v.results[pubkey]
+	if !ok {
+		return false, false
+	}
+
+	ttl := v.negativeTTL
+	if result.Verified {
+		ttl = v.positiveTTL
+	}
+
+	return result.Verified, time.Since(result.CheckedAt) < ttl
+}
+
+// lookup starts a background lookup for a pubkey, or joins the lookup already in flight
+func (v *cachedVerifier) lookup(pubkey string) *verificationCall {
+	v.Lock()
+	defer v.Unlock()
+
+	if call, ok := v.calls[pubkey]; ok {
+		return call
+	}
+
+	call := &verificationCall{done: make(chan struct{})}
+	v.calls[pubkey] = call
+
+	go func() {
+		v.slots <- struct{}{}
+		call.verified, call.err = v.verifier.Verify(pubkey)
+		<-v.slots
+
+		v.Lock()
+		// Errors aren't cached so the next request retries
+		if call.err == nil {
+			v.results[pubkey] = &verificationResult{Verified: call.verified, CheckedAt: time.Now()}
+		}
+		delete(v.calls, pubkey)
+		v.Unlock()
+
+		close(call.done)
+	}()
+
+	return call
+}
+
+// relayRegistrationVerifier checks whether a pubkey has paid to register with the nostr relay
+type relayRegistrationVerifier struct {
+	baseURL string
+}
+
+// relayRegistrationClient is the HTTP client used for relay registration checks
+var relayRegistrationClient = &http.Client{Timeout: 10 * time.Second}
+
+// Verify asks the relay's registration endpoint about a pubkey
+func (v *relayRegistrationVerifier) Verify(pubkey string) (bool, error) {
+	response, err := relayRegistrationClient.Get(v.baseURL + "/" + pubkey)
+	if err != nil {
+		return false, err
+	}
+
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.Contains(string(contents), "pubkey registered at timestamp"), nil
+}
+
+// allowlistVerifier checks pubkeys against a static list loaded from a file
+type allowlistVerifier struct {
+	pubkeys map[string]bool
+}
+
+// newAllowlistVerifier reads an allowlist file with one hex pubkey per line
+// blank lines and lines starting with # are ignored
+func newAllowlistVerifier(path string) *allowlistVerifier {
+	v := &allowlistVerifier{pubkeys: make(map[string]bool)}
+
+	file, err := os.Open(path)
+	if err != nil {
+		panic("unable to open verification allowlist: " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v.pubkeys[line] = true
+	}
+
+	log.Printf("loaded %d pubkeys from verification allowlist\n", len(v.pubkeys))
+	return v
+}
+
+// Verify checks whether a pubkey is on the allowlist
+func (v *allowlistVerifier) Verify(pubkey string) (bool, error) {
+	return v.pubkeys[pubkey], nil
+}
+
+// nip05DomainVerifier checks that a pubkey has a verified NIP-05 identifier on one of the accepted domains
+type nip05DomainVerifier struct {
+	domains []string
+}
+
+// Verify checks the domain of a pubkey's verified NIP-05 identifier
+func (v *nip05DomainVerifier) Verify(pubkey string) (bool, error) {
+	_, domain, err := schemas.ParseNIP05(verifiedNIP05(pubkey))
+	if err != nil {
+		return false, nil
+	}
+
+	for _, accepted := range v.domains {
+		if strings.ToLower(accepted) == domain {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// powVerifier checks that a pubkey was mined with a minimum number of leading zero bits
+type powVerifier struct {
+	difficulty int
+}
+
+// Verify counts a pubkey's leading zero bits
+func (v *powVerifier) Verify(pubkey string) (bool, error) {
+	return leadingZeroBits(pubkey) >= v.difficulty, nil
+}
+
+// alwaysVerifier treats every pubkey as verified
+type alwaysVerifier struct{}
+
+// Verify always returns true
+func (v *alwaysVerifier) Verify(pubkey string) (bool, error) {
+	return true, nil
+}
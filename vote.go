@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"math"
 	"net/http"
-	"strings"
 
 	"github.com/rdbell/go-nostr"
 	"github.com/rdbell/nvote/schemas"
@@ -17,6 +17,144 @@ import (
 // voteRoutes sets up vote-related routes
 func voteRoutes(e *echo.Echo) {
 	e.POST("/vote/:id", isLoggedIn(isVerified(voteSubmitHandler)))
+	e.GET("/p/:id/votes", postVotesHandler)
+}
+
+// voteTimelineBuckets is the number of bars in a post's vote timeline chart
+const voteTimelineBuckets = 24
+
+// postVoter defines a single vote on a post along with the voter's standing
+type postVoter struct {
+	PubKey    string  // voter's public key
+	Direction bool    // true for an upvote
+	Weight    float64 // how much the vote counts towards the post's weighted score
+	CreatedAt uint32  // vote timestamp
+	FirstSeen uint32  // when the voter was first seen by this gateway
+	UserScore int     // voter's user score
+}
+
+// AccountAge returns how old the voter's account was when the vote was cast, in seconds
+func (voter *postVoter) AccountAge() uint32 {
+	if voter.FirstSeen == 0 || voter.CreatedAt < voter.FirstSeen {
+		return 0
+	}
+	return voter.CreatedAt - voter.FirstSeen
+}
+
+// voteBucket defines the votes cast within one slice of a vote timeline
+type voteBucket struct {
+	Start uint32 // bucket start timestamp
+	Up    int    // upvotes cast during the bucket
+	Down  int    // downvotes cast during the bucket
+}
+
+// postVotesHandler serves every vote on a post with a timeline chart, so voting patterns can be audited
+func postVotesHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return serveError(c, http.StatusInternalServerError, errors.New("invalid ID"))
+	}
+
+	post, err := getPost(id)
+	if err != nil || isHidden(id) {
+		return serveError(c, http.StatusNotFound, errors.New("not found"))
+	}
+
+	var page struct {
+		Post      *schemas.Post
+		Voters    []*postVoter
+		Upvotes   int
+		Downvotes int
+		Chart     template.HTML
+	}
+	page.Post = post
+
+	page.Voters, err = votersForPost(id)
+	if err != nil {
+		return serveError(c, http.StatusInternalServerError, err)
+	}
+
+	for _, voter := range page.Voters {
+		if voter.Direction {
+			page.Upvotes++
+		} else {
+			page.Downvotes++
+		}
+	}
+
+	// Chart from the time of posting until the latest vote
+	end := post.CreatedAt + 3600
+	if len(page.Voters) > 0 && page.Voters[len(page.Voters)-1].CreatedAt > end {
+		end = page.Voters[len(page.Voters)-1].CreatedAt
+	}
+	page.Chart = voteTimelineSVG(bucketVotes(page.Voters, post.CreatedAt, end, voteTimelineBuckets))
+
+	pd := new(pageData).Init(c)
+	pd.Title = "Votes"
+	pd.Page = page
+	return c.Render(http.StatusOK, "base:post_votes", pd)
+}
+
+// votersForPost returns every vote on a post in the order they were cast
+func votersForPost(id string) ([]*postVoter, error) {
+	rows, err := db.Query(`
+		SELECT votes.pubkey, votes.direction, votes.weight, votes.created_at, COALESCE(users.first_seen, 0), COALESCE(users.user_score, 0)
+		FROM votes
+		LEFT JOIN users ON users.pubkey = votes.pubkey
+		WHERE votes.target = ?
+		ORDER BY votes.created_at ASC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var voters []*postVoter
+	for rows.Next() {
+		voter := &postVoter{}
+		err = rows.Scan(&voter.PubKey, &voter.Direction, &voter.Weight, &voter.CreatedAt, &voter.FirstSeen, &voter.UserScore)
+		if err != nil {
+			return nil, err
+		}
+		voters = append(voters, voter)
+	}
+
+	return voters, rows.Err()
+}
+
+// bucketVotes splits the time between start and end into evenly sized buckets and counts the votes cast in each
+// returns the buckets and the bucket size in seconds
+func bucketVotes(voters []*postVoter, start uint32, end uint32, count int) ([]*voteBucket, uint32) {
+	if end <= start {
+		end = start + 1
+	}
+
+	// Round bucket sizes up to a whole minute so labels stay readable
+	size := (end - start + uint32(count) - 1) / uint32(count)
+	size = (size + 59) / 60 * 60
+
+	buckets := make([]*voteBucket, count)
+	for i := range buckets {
+		buckets[i] = &voteBucket{Start: start + uint32(i)*size}
+	}
+
+	for _, voter := range voters {
+		// Votes timestamped before the post (clock skew) land in the first bucket
+		index := 0
+		if voter.CreatedAt > start {
+			index = int((voter.CreatedAt - start) / size)
+		}
+		if index >= count {
+			index = count - 1
+		}
+		if voter.Direction {
+			buckets[index].Up++
+		} else {
+			buckets[index].Down++
+		}
+	}
+
+	return buckets, size
 }
 
 // voteSubmitHandler handles an upvote/downvote
@@ -31,6 +169,11 @@ func voteSubmitHandler(c echo.Context) error {
 		return serveError(c, http.StatusUnauthorized, errors.New("you have already voted on this post"))
 	}
 
+	// Locked and archived threads don't accept new votes
+	if status := threadStatus(vote.Target); status != "" {
+		return serveError(c, http.StatusUnauthorized, errors.New("this thread is "+status))
+	}
+
 	// Serialize content
 	vote.PrepareForPublish()
 	content, err := json.Marshal(vote)
@@ -45,12 +188,7 @@ func voteSubmitHandler(c echo.Context) error {
 	}
 
 	// Attempt redirect back to page that the user came from
-	referer := c.Request().Header["Referer"]
-	if len(referer) != 0 && strings.Contains(referer[0], appConfig.SiteURL) {
-		return c.Redirect(http.StatusFound, referer[0])
-	}
-
-	return c.Redirect(http.StatusFound, fmt.Sprintf("/p/%s", vote.Target))
+	return redirectBack(c, fmt.Sprintf("/p/%s", vote.Target))
 }
 
 // alreadyVoted checks to see if a pubkey has already voted on a post
@@ -65,6 +203,9 @@ func alreadyVoted(target string, pubkey string) bool {
 
 // insertVote inserts a vote into the DB
 func insertVote(vote *schemas.Vote) error {
+	votesMutex.Lock()
+	defer votesMutex.Unlock()
+
 	// Ensure the user hasn't already voted on this target
 	if alreadyVoted(vote.Target, vote.PubKey) {
 		return errors.New("already voted")
@@ -76,8 +217,11 @@ func insertVote(vote *schemas.Vote) error {
 		vote.Channel = parent.Channel
 	}
 
+	// Weigh the vote by the voter's standing when it was cast, and by its proof-of-work
+	weight := voteWeight(vote.PubKey, vote.CreatedAt) * powVoteMultiplier(vote.PoW)
+
 	// Add to DB
-	_, err = db.Exec(`INSERT INTO votes(pubkey, target, channel, direction, created_at) VALUES(?,?,?,?,?)`, vote.PubKey, vote.Target, vote.Channel, vote.Direction, vote.CreatedAt)
+	_, err = db.Exec(`INSERT INTO votes(pubkey, target, channel, direction, weight, pow, created_at) VALUES(?,?,?,?,?,?,?)`, vote.PubKey, vote.Target, vote.Channel, vote.Direction, weight, vote.PoW, vote.CreatedAt)
 	if err != nil {
 		return err
 	}
@@ -90,15 +234,21 @@ func insertVote(vote *schemas.Vote) error {
 
 	var createdAt uint32
 	var score int32
+	var weightedScore float64
 	var postPubkey string
-	err = db.QueryRow(`UPDATE posts SET score = score + ? WHERE id = ? RETURNING created_at, score, pubkey`, direction, vote.Target).Scan(&createdAt, &score, &postPubkey)
+	var pow int
+	var postParent string
+	var postChannel string
+	err = db.QueryRow(`UPDATE posts SET score = score + ?, weighted_score = weighted_score + ? WHERE id = ? RETURNING created_at, score, weighted_score, pubkey, pow, parent, channel`,
+		direction, float64(direction)*weight, vote.Target).Scan(&createdAt, &score, &weightedScore, &postPubkey, &pow, &postParent, &postChannel)
 	if err != nil {
 		return err
 	}
 
 	// Update post ranking
 	// Would like to add this to the previous statement but can't calculate post ranking in a SQLite Query because sqlite3 driver isn't compiled with math functions enabled
-	ranking := reddit(score, createdAt)
+	// the weighted score matches the score unless votes are weighted by standing or down-ranked for lacking proof-of-work
+	ranking := postRanking(weightedScore, createdAt, pow, postParent)
 	_, err = db.Exec(`UPDATE posts SET ranking = ? WHERE id = ?`, ranking, vote.Target)
 	if err != nil {
 		return err
@@ -110,7 +260,8 @@ func insertVote(vote *schemas.Vote) error {
 		return err
 	}
 
-	return nil
+	// Update post owner's karma in the post's channel
+	return addKarma(postPubkey, postChannel, postParent != "", direction, vote.CreatedAt)
 }
 
 // fetchVotes fetches votes for a given set of filters
@@ -157,11 +308,16 @@ func fetchVotes(filters *schemas.VoteFilterset) ([]*schemas.Vote, error) {
 	return votes, err
 }
 
+// postRanking ranks a post by score and age, down-ranking posts that lack proof-of-work
+func postRanking(score float64, createdAt uint32, pow int, parent string) float64 {
+	return reddit(score, createdAt) - powPenalty(pow, parent)
+}
+
 // reddit style ranking
 // https://github.com/anhle128/go-ranking-algorithms
-func reddit(score int32, createdAt uint32) float64 {
+func reddit(score float64, createdAt uint32) float64 {
 	var sign float64
-	order := math.Log10(math.Max(math.Abs(float64(score)), 1))
+	order := math.Log10(math.Max(math.Abs(score), 1))
 	if score > 0 {
 		sign = 1
 	} else if score < 0 {
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"sync"
+	"time"
+)
+
+// voteWeightRefreshInterval is how often vote weights are recomputed from voters' current standing
+const voteWeightRefreshInterval = 10 * time.Minute
+
+// votesMutex serializes vote insertion with writing recomputed vote weights, which both update posts' weighted scores and rankings
+var votesMutex sync.Mutex
+
+// voterStanding defines what a voter's vote weight depends on
+type voterStanding struct {
+	firstSeen uint32
+	userScore int
+	verified  bool
+}
+
+// standingForPubkey queries the DB and returns a voter's standing
+// verification comes from the verification cache, so this never blocks on the backend. unknown voters count as unverified until their lookup completes
+func standingForPubkey(pubkey string) *voterStanding {
+	standing := &voterStanding{}
+	db.QueryRow(`SELECT COALESCE(first_seen, 0), COALESCE(user_score, 0) FROM users WHERE pubkey = ?`, pubkey).Scan(&standing.firstSeen, &standing.userScore)
+
+	// Only look up verification when it affects the weight
+	if multiplier := appConfig.VoteWeightUnverified; multiplier > 0 && multiplier < 1 {
+		standing.verified = peekVerification(pubkey)
+	}
+
+	return standing
+}
+
+// voteWeight returns how much a vote counts towards a post's weighted score
+// votes from new, low-scoring or unverified voters count for less. every vote counts as 1 unless vote weighting is enabled
+func voteWeight(pubkey string, createdAt uint32) float64 {
+	if !appConfig.VoteWeighting {
+		return 1
+	}
+
+	return standingForPubkey(pubkey).weight(createdAt)
+}
+
+// weight returns how much a vote cast at a given time counts, for a voter with this standing
+func (standing *voterStanding) weight(createdAt uint32) float64 {
+	weight := 1.0
+
+	// New accounts ramp up to full weight
+	if days := appConfig.VoteWeightFullAgeDays; days > 0 {
+		age := 0.0
+		if standing.firstSeen > 0 && createdAt > standing.firstSeen {
+			age = float64(createdAt-standing.firstSeen) / 86400
+		}
+		weight *= math.Min(age/float64(days), 1)
+	}
+
+	// Voter score scales the weight between nothing and double
+	if scale := appConfig.VoteWeightScoreScale; scale > 0 {
+		weight *= 1 + math.Max(-1, math.Min(float64(standing.userScore)/float64(scale), 1))
+	}
+
+	if multiplier := appConfig.VoteWeightUnverified; multiplier > 0 && multiplier < 1 && !standing.verified {
+		weight *= multiplier
+	}
+
+	return math.Max(weight, appConfig.VoteWeightMin)
+}
+
+// refreshVoteWeights periodically recomputes vote weights, picking up verification lookups that completed after a vote was ingested
+func refreshVoteWeights() {
+	for range time.Tick(voteWeightRefreshInterval) {
+		recomputeVoteWeights()
+	}
+}
+
+// recomputeVoteWeights recomputes every vote's weight from its voter's current standing
+// and updates the weighted score and ranking of posts whose votes changed.
+// verification comes from the cache without starting lookups, and new weights are computed before taking votesMutex,
+// which is only held while they're written so ingest isn't blocked for the whole run
+func recomputeVoteWeights() error {
+	if !appConfig.VoteWeighting {
+		return nil
+	}
+
+	standings, err := voterStandings()
+	if err != nil {
+		return err
+	}
+
+	type voteWeightChange struct {
+		rowid  int64
+		target string
+		weight float64
+	}
+
+	rows, err := db.Query(`SELECT rowid, pubkey, target, weight, COALESCE(pow, 0), created_at FROM votes`)
+	if err != nil {
+		return err
+	}
+
+	var changes []*voteWeightChange
+	for rows.Next() {
+		change := &voteWeightChange{}
+		var pubkey string
+		var weight float64
+		var pow int
+		var createdAt uint32
+		if err = rows.Scan(&change.rowid, &pubkey, &change.target, &weight, &pow, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+
+		standing, ok := standings[pubkey]
+		if !ok {
+			standing = &voterStanding{}
+		}
+
+		change.weight = standing.weight(createdAt) * powVoteMultiplier(pow)
+		if math.Abs(change.weight-weight) > 1e-9 {
+			changes = append(changes, change)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	votesMutex.Lock()
+	defer votesMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	targets := make(map[string]bool)
+	for _, change := range changes {
+		if _, err = tx.Exec(`UPDATE votes SET weight = ? WHERE rowid = ?`, change.weight, change.rowid); err != nil {
+			tx.Rollback()
+			return err
+		}
+		targets[change.target] = true
+	}
+
+	// Rerank only the posts whose votes changed
+	for target := range targets {
+		var weightedScore float64
+		var createdAt uint32
+		var pow int
+		var parent string
+		err = tx.QueryRow(`UPDATE posts SET weighted_score = (SELECT COALESCE(SUM(CASE WHEN direction THEN weight ELSE -weight END), 0) FROM votes WHERE target = ?1) WHERE id = ?1
+			RETURNING weighted_score, created_at, pow, parent`, target).Scan(&weightedScore, &createdAt, &pow, &parent)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err == nil {
+			_, err = tx.Exec(`UPDATE posts SET ranking = ? WHERE id = ?`, postRanking(weightedScore, createdAt, pow, parent), target)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// voterStandings queries the DB and returns the standing of every pubkey that has voted
+// verification is read from the cache only. voters without a cached result count as unverified until they're looked up elsewhere
+func voterStandings() (map[string]*voterStanding, error) {
+	standings := make(map[string]*voterStanding)
+
+	rows, err := db.Query(`SELECT pubkey, COALESCE(first_seen, 0), COALESCE(user_score, 0) FROM users WHERE pubkey IN (SELECT DISTINCT pubkey FROM votes)`)
+	if err != nil {
+		return standings, err
+	}
+	defer rows.Close()
+
+	checkVerified := appConfig.VoteWeightUnverified > 0 && appConfig.VoteWeightUnverified < 1
+	for rows.Next() {
+		var pubkey string
+		standing := &voterStanding{}
+		if err = rows.Scan(&pubkey, &standing.firstSeen, &standing.userScore); err != nil {
+			return standings, err
+		}
+		if checkVerified {
+			standing.verified = cachedVerification(pubkey)
+		}
+		standings[pubkey] = standing
+	}
+
+	return standings, rows.Err()
+}
+
+// scoreColumn returns the posts column that score ordering should use
+func scoreColumn() string {
+	if appConfig.VoteWeighting {
+		return "weighted_score"
+	}
+	return "score"
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rdbell/nvote/schemas"
+
+	"github.com/labstack/echo/v4"
+)
+
+// trustGraphs tracks which viewers have a computed web of trust in the trust table
+var trustGraphs = struct {
+	sync.Mutex
+	computedAt map[string]time.Time // when each viewer's trust set was last rebuilt
+	lastUsed   map[string]time.Time // when each viewer's trust set was last queried
+	size       map[string]int       // number of trusted pubkeys, including the viewer
+	queued     map[string]bool      // viewers waiting in trustQueue
+}{
+	computedAt: make(map[string]time.Time),
+	lastUsed:   make(map[string]time.Time),
+	size:       make(map[string]int),
+	queued:     make(map[string]bool),
+}
+
+// trustQueue is a queue of viewers whose trust sets need rebuilding
+var trustQueue = make(chan string, 1000)
+
+// trustIdleTimeout is how long a viewer's trust set is kept without being used
+const trustIdleTimeout = 24 * time.Hour
+
+// trustedBy returns the logged in user's pubkey if their feeds should be filtered and ranked by their web of trust
+// an empty trust set (no follows yet), or one still being computed, falls back to the global listings
+func trustedBy(c echo.Context) string {
+	user := c.Get("user").(*schemas.User)
+	if user.PubKey == "" || !user.WebOfTrust {
+		return ""
+	}
+
+	if ensureTrustGraph(user.PubKey) <= 1 {
+		return ""
+	}
+
+	return user.PubKey
+}
+
+// ensureTrustGraph returns the size of a viewer's trust set
+// missing and stale sets are computed in the background. until the first one is ready the size is 0, so feeds fall back to the global listings
+func ensureTrustGraph(viewer string) int {
+	trustGraphs.Lock()
+	trustGraphs.lastUsed[viewer] = time.Now()
+	computedAt, ok := trustGraphs.computedAt[viewer]
+	size := trustGraphs.size[viewer]
+	trustGraphs.Unlock()
+
+	if !ok || time.Since(computedAt) > trustRefreshInterval() {
+		queueTrustRebuild(viewer)
+	}
+
+	return size
+}
+
+// queueTrustRebuild queues a viewer's trust set for rebuilding, unless it's already queued
+func queueTrustRebuild(viewer string) {
+	trustGraphs.Lock()
+	defer trustGraphs.Unlock()
+
+	if trustGraphs.queued[viewer] {
+		return
+	}
+
+	// Don't block page rendering if the queue is full. The periodic refresh will pick it up
+	select {
+	case trustQueue <- viewer:
+		trustGraphs.queued[viewer] = true
+	default:
+	}
+}
+
+// invalidateTrustGraphs queues a rebuild of every trust set that depends on a pubkey's follows or mutes
+func invalidateTrustGraphs(pubkey string) {
+	rows, err := db.Query(`SELECT viewer FROM trust WHERE pubkey = ?`, pubkey)
+	if err != nil {
+		return
+	}
+
+	var viewers []string
+	for rows.Next() {
+		var viewer string
+		if rows.Scan(&viewer) == nil {
+			viewers = append(viewers, viewer)
+		}
+	}
+	rows.Close()
+
+	for _, viewer := range viewers {
+		queueTrustRebuild(viewer)
+	}
+}
+
+// refreshTrustGraphs rebuilds queued trust sets and periodically refreshes the ones still in use
+func refreshTrustGraphs() {
+	go func() {
+		for range time.Tick(trustRefreshInterval()) {
+			trustGraphs.Lock()
+			var active, idle []string
+			for viewer, lastUsed := range trustGraphs.lastUsed {
+				if time.Since(lastUsed) > trustIdleTimeout {
+					idle = append(idle, viewer)
+				} else {
+					active = append(active, viewer)
+				}
+			}
+			trustGraphs.Unlock()
+
+			for _, viewer := range idle {
+				forgetTrustGraph(viewer)
+			}
+			for _, viewer := range active {
+				queueTrustRebuild(viewer)
+			}
+		}
+	}()
+
+	for viewer := range trustQueue {
+		trustGraphs.Lock()
+		delete(trustGraphs.queued, viewer)
+		trustGraphs.Unlock()
+
+		rebuildTrustGraph(viewer)
+	}
+}
+
+// trustRefreshInterval returns how often trust sets are rebuilt
+func trustRefreshInterval() time.Duration {
+	interval := time.Duration(appConfig.WoTRefreshMinutes) * time.Minute
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	return interval
+}
+
+// rebuildTrustGraph computes a viewer's trust set and replaces their rows in the trust table
+func rebuildTrustGraph(viewer string) int {
+	weights := computeTrust(viewer)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0
+	}
+	tx.Exec(`DELETE FROM trust WHERE viewer = ?`, viewer)
+	for pubkey, weight := range weights {
+		tx.Exec(`INSERT INTO trust(viewer, pubkey, weight) VALUES(?,?,?)`, viewer, pubkey, weight)
+	}
+	if tx.Commit() != nil {
+		return 0
+	}
+
+	trustGraphs.Lock()
+	trustGraphs.computedAt[viewer] = time.Now()
+	trustGraphs.size[viewer] = len(weights)
+	trustGraphs.Unlock()
+
+	return len(weights)
+}
+
+// forgetTrustGraph drops an idle viewer's trust set
+func forgetTrustGraph(viewer string) {
+	trustGraphs.Lock()
+	delete(trustGraphs.computedAt, viewer)
+	delete(trustGraphs.lastUsed, viewer)
+	delete(trustGraphs.size, viewer)
+	trustGraphs.Unlock()
+
+	db.Exec(`DELETE FROM trust WHERE viewer = ?`, viewer)
+}
+
+// computeTrust walks a viewer's follow graph out to the configured number of hops
+// direct follows get a weight of 1, and each further hop is multiplied by the decay factor.
+// a pubkey muted by someone trusted at least as much as the pubkey itself is dropped from the set
+func computeTrust(viewer string) map[string]float64 {
+	maxHops := appConfig.WoTMaxHops
+	if maxHops <= 0 {
+		maxHops = 3
+	}
+	decay := appConfig.WoTDecay
+	if decay <= 0 || decay > 1 {
+		decay = 0.5
+	}
+	maxSize := appConfig.WoTMaxSize
+	if maxSize <= 0 {
+		maxSize = 10000
+	}
+
+	weights := map[string]float64{viewer: 1}
+	frontier := []string{viewer}
+	for hop := 1; hop <= maxHops && len(frontier) > 0 && len(weights) < maxSize; hop++ {
+		weight := math.Pow(decay, float64(hop-1))
+
+		var next []string
+		for _, pubkey := range frontier {
+			for _, target := range followsForPubkey(pubkey) {
+				if _, ok := weights[target]; ok {
+					continue
+				}
+				weights[target] = weight
+				next = append(next, target)
+				if len(weights) >= maxSize {
+					break
+				}
+			}
+		}
+		frontier = next
+	}
+
+	// Collect the strongest mute against each pubkey before removing anything,
+	// so the result doesn't depend on map iteration order
+	distrust := make(map[string]float64)
+	for pubkey, weight := range weights {
+		for _, muted := range mutedPubkeys(pubkey) {
+			if weight > distrust[muted] {
+				distrust[muted] = weight
+			}
+		}
+	}
+
+	for pubkey, weight := range distrust {
+		if pubkey != viewer && weights[pubkey] > 0 && weight >= weights[pubkey] {
+			delete(weights, pubkey)
+		}
+	}
+
+	return weights
+}
+
+// followsForPubkey returns the pubkeys on a user's contact list
+func followsForPubkey(pubkey string) []string {
+	var targets []string
+
+	rows, err := db.Query(`SELECT target FROM follows WHERE pubkey = ?`, pubkey)
+	if err != nil {
+		return targets
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var target string
+		if rows.Scan(&target) == nil {
+			targets = append(targets, target)
+		}
+	}
+
+	return targets
+}
+
+// mutedPubkeys returns the pubkeys on a user's mute list
+func mutedPubkeys(pubkey string) []string {
+	var muted []string
+
+	rows, err := db.Query(`SELECT value FROM mutes WHERE pubkey = ? AND tag = ?`, pubkey, schemas.MuteTagPubKey)
+	if err != nil {
+		return muted
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value string
+		if rows.Scan(&value) == nil {
+			muted = append(muted, value)
+		}
+	}
+
+	return muted
+}
+
+// trustedScoreStmt returns a SQL expression summing a post's votes weighted by the trust set bound to the numbered parameter
+// each vote's own weight applies too, which is always 1 unless vote weighting is enabled
+func trustedScoreStmt(param int) string {
+	return fmt.Sprintf(`(SELECT COALESCE(SUM(CASE WHEN votes.direction THEN trust.weight * votes.weight ELSE -trust.weight * votes.weight END), 0) FROM votes JOIN trust ON trust.pubkey = votes.pubkey AND trust.viewer = ?%d WHERE votes.target = posts.id)`, param)
+}
+
+// trustedStmt returns a SQL condition hiding posts by pubkeys outside the trust set bound to the numbered parameter
+func trustedStmt(param int) string {
+	return fmt.Sprintf(" AND posts.pubkey IN (SELECT pubkey FROM trust WHERE trust.viewer = ?%d)", param)
+}
+
+// trustedRanking ranks a post by its trust-weighted score
+// registered with sqlite as trusted_ranking() so personalized feeds can be sorted in the query
+func trustedRanking(score float64, createdAt int64, pow int64, parent string) float64 {
+	return reddit(score, uint32(createdAt)) - powPenalty(int(pow), parent)
+}